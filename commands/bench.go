@@ -0,0 +1,114 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
+)
+
+//Bench asks the daemon to coordinate a benchmark between members
+//and prints the throughput each member measured from the others
+var Bench = cli.Command{
+	Name:  "bench",
+	Usage: "measure the throughput and latency between members",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{Name: "member,m", Value: &cli.StringSlice{}, Usage: "name of a member to include, can be repeated (default: all members)"},
+		cli.StringFlag{Name: "size", Value: "10M", Usage: "number of bytes each member downloads from every other member"},
+		cli.DurationFlag{Name: "timeout", Value: time.Minute * 10, Usage: "how long to wait for all results"},
+	},
+	Action: func(c *cli.Context) {
+		size, err := services.ParseSize(c.String("size"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		addr := controlSocket(c)
+		req := &services.BenchRequest{Members: c.StringSlice("member"), Size: size}
+		args, err := json.Marshal(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		out, err := services.CallControl(addr, "bench", args)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = json.Unmarshal(out, req)
+		if err != nil {
+			log.Fatalf("Failed to decode bench: %s", err)
+		}
+
+		//every member measures all others
+		expected := len(req.Members) * (len(req.Members) - 1)
+		log.Printf("Started bench '%s', waiting for %d results...", req.ID, expected)
+		results := []*services.BenchResult{}
+		deadline := time.Now().Add(c.Duration("timeout"))
+		for len(results) < expected && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+			out, err := services.CallControl(addr, "bench/results", []byte(req.ID))
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			err = json.Unmarshal(out, &results)
+			if err != nil {
+				log.Fatalf("Failed to decode bench results: %s", err)
+			}
+		}
+
+		if len(results) < expected {
+			log.Printf("Timed out, %d of %d results arrived", len(results), expected)
+		}
+
+		//rows download from the columns
+		matrix := map[string]map[string]*services.BenchResult{}
+		for _, res := range results {
+			if matrix[res.From] == nil {
+				matrix[res.From] = map[string]*services.BenchResult{}
+			}
+
+			matrix[res.From][res.To] = res
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprint(w, "FROM \\ TO")
+		for _, to := range req.Members {
+			fmt.Fprintf(w, "\t%s", to)
+		}
+
+		fmt.Fprintln(w)
+		for _, from := range req.Members {
+			fmt.Fprint(w, from)
+			for _, to := range req.Members {
+				res, ok := matrix[from][to]
+				switch {
+				case from == to:
+					fmt.Fprint(w, "\t-")
+				case !ok:
+					fmt.Fprint(w, "\t?")
+				case res.Error != "":
+					fmt.Fprint(w, "\terror")
+				default:
+					fmt.Fprintf(w, "\t%.1f MiB/s (%s)", res.Throughput/(1024*1024), res.RTT)
+				}
+			}
+
+			fmt.Fprintln(w)
+		}
+
+		w.Flush()
+		for _, res := range results {
+			if res.Error != "" {
+				fmt.Printf("%s from %s: %s\n", res.From, res.To, res.Error)
+			}
+		}
+	},
+}
@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
+)
+
+var chunkFlags = []cli.Flag{
+	cli.StringFlag{Name: "node,n", Value: "http://127.0.0.1:3838", Usage: "git http endpoint of any cellstate node"},
+	cli.StringFlag{Name: "user,u", Usage: "name of the user to authenticate as"},
+	cli.StringFlag{Name: "password,p", EnvVar: "CELL_PASSWORD", Usage: "password of the user, or a token when no user is given"},
+}
+
+//userTransport authenticates every request as a user
+type userTransport struct {
+	user     string
+	password string
+}
+
+func (t *userTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	if t.user == "" {
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.password))
+	} else {
+		r.SetBasicAuth(t.user, t.password)
+	}
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+//chunkClient authenticates as a user or, without credentials, signs
+//requests with the cluster secret like members do
+func chunkClient(c *cli.Context) *http.Client {
+	if c.String("user") != "" || c.String("password") != "" {
+		return &http.Client{Transport: &userTransport{user: c.String("user"), password: c.String("password")}}
+	}
+
+	auth, err := services.NewClusterAuth(c.GlobalString("secret"))
+	if err != nil {
+		log.Fatalf("Failed to authenticate, pass the --user and --password of a user or the --secret of the cluster: %s", err)
+	}
+
+	return &http.Client{Transport: auth.Transport(http.DefaultTransport)}
+}
+
+//Chunk moves large files into the chunk store of a node, the
+//pointer that is printed is committed in place of the file
+var Chunk = cli.Command{
+	Name:  "chunk",
+	Usage: "...",
+	Subcommands: []cli.Command{
+		{
+			Name:  "put",
+			Usage: "split a file into chunks, upload them to a node and print the pointer",
+			Flags: chunkFlags,
+			Action: func(c *cli.Context) {
+				path := c.Args().First()
+				if path == "" {
+					log.Fatalf("Failed, Please provide the file to chunk as the first argument")
+				}
+
+				f, err := os.Open(path)
+				if err != nil {
+					log.Fatalf("Failed to open '%s': %s", path, err)
+				}
+
+				defer f.Close()
+				client := chunkClient(c)
+				base := fmt.Sprintf("%s/chunks/", strings.TrimRight(c.String("node"), "/"))
+				p, manifest, err := services.SplitChunks(f, func(ref services.ChunkRef, data []byte) error {
+					return services.UploadChunk(client, base, ref.Hash, data)
+				})
+
+				if err != nil {
+					log.Fatalf("Failed to upload chunks of '%s': %s", path, err)
+				}
+
+				err = services.UploadChunk(client, base, p.Manifest, manifest)
+				if err != nil {
+					log.Fatalf("Failed to upload manifest of '%s': %s", path, err)
+				}
+
+				fmt.Print(p.String())
+			},
+		},
+		{
+			Name:  "get",
+			Usage: "write the file a pointer references to stdout",
+			Flags: chunkFlags,
+			Action: func(c *cli.Context) {
+				path := c.Args().First()
+				if path == "" {
+					log.Fatalf("Failed, Please provide the pointer file as the first argument")
+				}
+
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					log.Fatalf("Failed to read pointer '%s': %s", path, err)
+				}
+
+				p, err := services.ParseChunkPointer(data)
+				if err != nil {
+					log.Fatalf("Failed to parse pointer '%s': %s", path, err)
+				}
+
+				client := chunkClient(c)
+				base := fmt.Sprintf("%s/chunks/", strings.TrimRight(c.String("node"), "/"))
+				download := func(hash string) ([]byte, error) {
+					return services.DownloadChunk(client, base, hash)
+				}
+
+				err = services.WalkManifest(p.Manifest, download, func(ref services.ChunkRef) error {
+					data, err := download(ref.Hash)
+					if err != nil {
+						return err
+					}
+
+					_, err = os.Stdout.Write(data)
+					return err
+				})
+
+				if err != nil {
+					log.Fatalf("Failed to get '%s': %s", path, err)
+				}
+			},
+		},
+	},
+}
@@ -0,0 +1,39 @@
+package commands
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
+)
+
+//Event is invoked by serf for every user event, it
+//forwards the event to the daemon's control api
+var Event = cli.Command{
+	Name:  "event",
+	Usage: "...",
+	Flags: []cli.Flag{},
+	Action: func(c *cli.Context) {
+		name := os.Getenv("SERF_USER_EVENT")
+		if name == "" {
+			log.Fatalf("Failed, expected to be invoked as a serf user event handler")
+		}
+
+		buff := bytes.NewBuffer(nil)
+		_, err := io.Copy(buff, os.Stdin)
+		if err != nil {
+			log.Fatalf("failed to read Stdin: %s", err)
+		}
+
+		addr := controlSocket(c)
+		log.Printf("Forwarding '%s' event to daemon at '%s'...", name, addr)
+		_, err = services.CallControl(addr, "event/"+name, bytes.TrimSpace(buff.Bytes()))
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
+)
+
+//GC runs a garbage collection on the daemon right away
+var GC = cli.Command{
+	Name:  "gc",
+	Usage: "remove old snapshots and unreferenced data, stop seeding what all members have",
+	Flags: []cli.Flag{},
+	Action: func(c *cli.Context) {
+		out, err := services.CallControl(controlSocket(c), "gc", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		report := &services.GCReport{}
+		err = json.Unmarshal(out, report)
+		if err != nil {
+			log.Fatalf("Failed to decode gc report: %s", err)
+		}
+
+		fmt.Printf("removed %d snapshots, %d chunks and %d lfs objects, freeing %d bytes\n", report.Snapshots, report.Chunks, report.Objects, report.Freed)
+		fmt.Printf("stopped seeding %d links\n", report.Dropped)
+	},
+}
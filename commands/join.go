@@ -1,10 +1,13 @@
 package commands
 
 import (
+	"encoding/json"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"time"
 
 	"github.com/codegangsta/cli"
 
@@ -12,12 +15,42 @@ import (
 	"github.com/cellstate/cell/services"
 )
 
+//data dir of nodes that weren't given one
+const defaultDataDir = "~/.cellstate"
+
+//controlSocket returns the control socket of the local node, it lives
+//in the data dir of the node unless it is given explicitly
+func controlSocket(c *cli.Context) string {
+	if path := c.GlobalString("control"); path != "" {
+		return path
+	}
+
+	dir := os.Getenv("CELL_DATA_DIR")
+	if dir == "" {
+		dir = defaultDataDir
+	}
+
+	return filepath.Join(dir, "control.sock")
+}
+
 var Join = cli.Command{
 	Name:  "join",
 	Usage: "...",
 	Flags: []cli.Flag{
+		cli.StringFlag{Name: "data-dir,d", Value: defaultDataDir, EnvVar: "CELL_DATA_DIR", Usage: "directory that holds all state of this node"},
 		cli.StringFlag{Name: "interface,i", Value: "zt0", Usage: "..."},
 		cli.StringFlag{Name: "group,g", Value: "224.0.0.250", Usage: "..."},
+		cli.StringFlag{Name: "transfer", Value: "torrent", Usage: "how snapshots are transferred: 'torrent' for bundles over BitTorrent or 'swarm' for git objects from several members"},
+		cli.StringFlag{Name: "upload-rate", Usage: "maximum upload rate of this node in bytes per second, e.g. '512k' or '10M'"},
+		cli.StringFlag{Name: "download-rate", Usage: "maximum download rate of this node in bytes per second"},
+		cli.StringFlag{Name: "peer-upload-rate", Usage: "maximum upload rate to a single peer in bytes per second"},
+		cli.StringFlag{Name: "peer-download-rate", Usage: "maximum download rate from a single peer in bytes per second"},
+		cli.IntFlag{Name: "keep-snapshots", Value: 5, Usage: "number of snapshots to keep per repository"},
+		cli.DurationFlag{Name: "gc-interval", Value: time.Hour, Usage: "how often garbage is collected in the background, zero disables it"},
+		cli.StringFlag{Name: "create", Value: "push", Usage: "how repositories are created: 'push' on the first push or 'explicit' with 'cell repo create' only"},
+		cli.IntFlag{Name: "ssh-port", Value: 2222, Usage: "port of the ssh server for git clients, zero disables it"},
+		cli.StringSliceFlag{Name: "window", Value: &cli.StringSlice{}, Usage: "daily window in local time during which data is transferred, e.g. '19:00-07:00', can be repeated"},
+		cli.StringSliceFlag{Name: "merge-program", Value: &cli.StringSlice{}, Usage: "program that repositories can use as merge strategy, e.g. 'csv=/usr/local/bin/merge-csv', can be repeated"},
 	},
 	Action: func(c *cli.Context) {
 
@@ -26,11 +59,38 @@ var Join = cli.Command{
 			log.Fatalf("Failed, Please provide the network ID to join as the first argument")
 		}
 
-		exit := make(chan os.Signal)
+		exit := make(chan os.Signal, 1)
 		signal.Notify(exit, os.Interrupt, os.Kill)
 		defer log.Println("Exited!")
 
-		var err error
+		data, err := services.NewDataDir(c.String("data-dir"))
+		if err != nil {
+			log.Fatalf("Failed to setup data dir: %s", err)
+		}
+
+		controlPath := c.GlobalString("control")
+		if controlPath == "" {
+			controlPath = data.Control()
+		}
+
+		if c.String("create") != "push" && c.String("create") != "explicit" {
+			log.Fatalf("Failed, unknown create policy '%s'", c.String("create"))
+		}
+
+		for _, program := range c.StringSlice("merge-program") {
+			err = services.RegisterMergeProgram(program)
+			if err != nil {
+				log.Fatalf("Failed to register merge program: %s", err)
+			}
+		}
+
+		limits, err := transferLimits(c)
+		if err != nil {
+			log.Fatalf("Failed to parse transfer limits: %s", err)
+		}
+
+		bandwidth := services.NewBandwidth(limits)
+
 		var zeroc *zerotier.Client
 		token := c.GlobalString("token")
 		if token != "" {
@@ -40,6 +100,17 @@ var Join = cli.Command{
 			}
 		}
 
+		//anyone can know the network id, the secret can't be derived
+		secret := c.GlobalString("secret")
+		if secret == "" {
+			log.Fatalf("Failed, no cluster secret configured: pass the same --secret or CELL_SECRET to every member")
+		}
+
+		auth, err := services.NewClusterAuth(secret)
+		if err != nil {
+			log.Fatalf("Failed to setup cluster authentication: %s", err)
+		}
+
 		//
 		// VPN service
 		//
@@ -85,7 +156,10 @@ var Join = cli.Command{
 		// Gossip service
 		//
 		sconf := services.SerfConf{
-			Bind: ip.String(),
+			Bind:         ip.String(),
+			Node:         member,
+			SnapshotPath: filepath.Join(data.Members(), "serf.snapshot"),
+			Control:      controlPath,
 		}
 
 		gossip, err := services.NewSerf(sconf)
@@ -110,12 +184,47 @@ var Join = cli.Command{
 		//
 		// Exchange Service
 		//
-		exchange, err := services.NewDeluge(gossip, ip)
+		stconf := services.StorageConf{
+			Port:           3838,
+			Data:           data,
+			FetchThreshold: 1024 * 1024,
+			KeepSnapshots:  c.Int("keep-snapshots"),
+			GCInterval:     c.Duration("gc-interval"),
+			SSHPort:        c.Int("ssh-port"),
+			Auth:           auth,
+			AutoCreate:     c.String("create") == "push",
+			Node:           member,
+			Bandwidth:      bandwidth,
+		}
+
+		var exchange services.Exchange
+		switch c.String("transfer") {
+		case "torrent":
+			xconf := services.ExchangeConf{
+				TrackerPort: 9000,
+				PeerPort:    50007,
+				TorrentDir:  data.Transfers(),
+				WebseedPort: stconf.Port,
+				Bandwidth:   bandwidth,
+
+				MetadataDir:  filepath.Join(data.Transfers(), "torrents"),
+				MetadataPort: 3842,
+				Auth:         auth,
+			}
+
+			exchange, err = services.NewTorrentExchange(xconf, gossip, ip)
+		case "swarm":
+			stconf.ObjectTransfer = true
+			exchange, err = services.NewObjectSwarm(gossip, ip, data.Repos(), 3840, bandwidth, auth)
+		default:
+			log.Fatalf("Failed, unknown transfer '%s'", c.String("transfer"))
+		}
+
 		if err != nil {
 			log.Fatalf("Failed to create exchange service: %s", err)
 		}
 
-		log.Printf("Starting Deluge BitTorrent daemon...")
+		log.Printf("Starting '%s' exchange...", c.String("transfer"))
 		err = exchange.Start()
 		if err != nil {
 			log.Fatalf("Failed to start exchange service: %s", err)
@@ -129,25 +238,208 @@ var Join = cli.Command{
 			}
 		}()
 
-		burl, err := exchange.Benchmark()
+		//
+		// Control service
+		//
+		control, err := services.NewControl(controlPath)
 		if err != nil {
-			log.Fatalf("Failed to setup benchmark: %s", err)
+			log.Fatalf("Failed to create control service: %s", err)
+		}
+
+		//links that are pulled by hand are downloaded next to the journal
+		downloads := filepath.Join(data.Transfers(), "downloads")
+		pull := func(args []byte) ([]byte, error) {
+			err := os.MkdirAll(downloads, 0777)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, exchange.Pull(string(args), downloads)
 		}
 
+		control.Handle("pull", pull)
+		control.Handle("transfers", func(args []byte) ([]byte, error) {
+			return json.Marshal(exchange.Transfers())
+		})
+
 		//
 		// Storage Service
 		//
-		storage, err := services.NewGitServer(exchange, gossip, ip)
+		storage, err := services.NewGitServer(stconf, exchange, gossip, ip)
 		if err != nil {
 			log.Fatalf("Failed to create storage service: %s", err)
 		}
 
-		log.Printf("Starting Deluge BitTorrent daemon...")
+		log.Printf("Starting storage service...")
 		err = storage.Start()
 		if err != nil {
 			log.Fatalf("Failed to start storage service: %s", err)
 		}
 
+		control.Handle("gc", func(args []byte) ([]byte, error) {
+			report, err := storage.GC()
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(report)
+		})
+
+		control.Handle("event/snapshot", func(args []byte) ([]byte, error) {
+			s := &services.Snapshot{}
+			err := json.Unmarshal(args, s)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, storage.Pull(s)
+		})
+
+		control.Handle("event/lfs_object", func(args []byte) ([]byte, error) {
+			o := &services.LFSObject{}
+			err := json.Unmarshal(args, o)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, storage.PullObject(o)
+		})
+
+		control.Handle("keys", func(args []byte) ([]byte, error) {
+			return json.Marshal(storage.Keys())
+		})
+
+		control.Handle("keys/add", func(args []byte) ([]byte, error) {
+			k := &services.AuthorizedKey{}
+			err := json.Unmarshal(args, k)
+			if err != nil {
+				return nil, err
+			}
+
+			k, err = storage.AddKey(k.Name, []byte(k.Key))
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(k)
+		})
+
+		control.Handle("keys/remove", func(args []byte) ([]byte, error) {
+			return nil, storage.RemoveKey(string(args))
+		})
+
+		control.Handle("repos", func(args []byte) ([]byte, error) {
+			repos, err := storage.Repos()
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(repos)
+		})
+
+		control.Handle("repos/integrations", func(args []byte) ([]byte, error) {
+			ins, err := storage.Integrations(string(args))
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(ins)
+		})
+
+		control.Handle("repos/create", func(args []byte) ([]byte, error) {
+			info, err := storage.CreateRepo(string(args))
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(info)
+		})
+
+		control.Handle("repos/strategy", func(args []byte) ([]byte, error) {
+			info := &services.RepoInfo{}
+			err := json.Unmarshal(args, info)
+			if err != nil {
+				return nil, err
+			}
+
+			info, err = storage.SetStrategy(info.Name, info.Strategy)
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(info)
+		})
+
+		access := storage.Access()
+		control.Handle("users", func(args []byte) ([]byte, error) {
+			return json.Marshal(access.Users())
+		})
+
+		control.Handle("users/add", func(args []byte) ([]byte, error) {
+			req := &services.UserRequest{}
+			err := json.Unmarshal(args, req)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, access.AddUser(req)
+		})
+
+		control.Handle("users/remove", func(args []byte) ([]byte, error) {
+			return nil, access.RemoveUser(string(args))
+		})
+
+		control.Handle("users/grant", func(args []byte) ([]byte, error) {
+			g := &services.Grant{}
+			err := json.Unmarshal(args, g)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, access.Grant(g)
+		})
+
+		control.Handle("users/revoke", func(args []byte) ([]byte, error) {
+			g := &services.Grant{}
+			err := json.Unmarshal(args, g)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, access.Revoke(g)
+		})
+
+		control.Handle("acls", func(args []byte) ([]byte, error) {
+			return json.Marshal(access.ACLs())
+		})
+
+		control.Handle("tokens", func(args []byte) ([]byte, error) {
+			return json.Marshal(access.Tokens())
+		})
+
+		control.Handle("tokens/create", func(args []byte) ([]byte, error) {
+			t, err := access.CreateToken(string(args))
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(t)
+		})
+
+		control.Handle("tokens/remove", func(args []byte) ([]byte, error) {
+			return nil, access.RemoveToken(string(args))
+		})
+
+		control.Handle("event/set_update", func(args []byte) ([]byte, error) {
+			u := &services.SetUpdate{}
+			err := json.Unmarshal(args, u)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, storage.SyncSet(u)
+		})
+
 		defer func() {
 			log.Printf("Stopping storage service...")
 			err := storage.Stop()
@@ -156,6 +448,83 @@ var Join = cli.Command{
 			}
 		}()
 
+		//
+		// Bench service
+		//
+		bench, err := services.NewBench(gossip, ip, 3841, auth)
+		if err != nil {
+			log.Fatalf("Failed to create bench service: %s", err)
+		}
+
+		log.Printf("Starting bench service...")
+		err = bench.Start()
+		if err != nil {
+			log.Fatalf("Failed to start bench service: %s", err)
+		}
+
+		control.Handle("bench", func(args []byte) ([]byte, error) {
+			req := &services.BenchRequest{}
+			err := json.Unmarshal(args, req)
+			if err != nil {
+				return nil, err
+			}
+
+			req, err = bench.Run(req)
+			if err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(req)
+		})
+
+		control.Handle("bench/results", func(args []byte) ([]byte, error) {
+			return json.Marshal(bench.Results(string(args)))
+		})
+
+		control.Handle("event/bench", func(args []byte) ([]byte, error) {
+			req := &services.BenchRequest{}
+			err := json.Unmarshal(args, req)
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, bench.Handle(req)
+		})
+
+		control.Handle("event/bench_result", func(args []byte) ([]byte, error) {
+			res := &services.BenchResult{}
+			err := json.Unmarshal(args, res)
+			if err != nil {
+				return nil, err
+			}
+
+			bench.Collect(res)
+			return nil, nil
+		})
+
+		defer func() {
+			log.Printf("Stopping bench service...")
+			err := bench.Stop()
+			if err != nil {
+				log.Fatalf("Failed to stop bench: %s", err)
+			}
+		}()
+
+		//calls are only accepted once every handler is registered
+		log.Printf("Starting control service...")
+		err = control.Start()
+		if err != nil {
+			log.Fatalf("Failed to start control service: %s", err)
+		}
+
+		defer func() {
+			log.Printf("Stopping control service...")
+			err := control.Stop()
+			if err != nil {
+				log.Fatalf("Failed to stop control: %s", err)
+			}
+		}()
+
 		//
 		// Discovery service
 		//
@@ -189,13 +558,40 @@ var Join = cli.Command{
 			log.Fatalf("Failed to start multicasting: %s", err)
 		}
 
-		log.Printf("Gossip is up and running, gossiping benchmark torrent '%s'...", burl)
-		err = gossip.EmitTorrent(burl)
-		if err != nil {
-			log.Fatalf("Failed to gossip torren url '%s': %s", burl, err)
-		}
+		log.Printf("Gossip is up and running, resuming interrupted pulls...")
+		storage.Resume()
 
 		<-exit //block until signal
 
 	},
 }
+
+//transferLimits parses the bandwidth and window flags of join
+func transferLimits(c *cli.Context) (services.TransferLimits, error) {
+	limits := services.TransferLimits{}
+	rates := map[string]*int64{
+		"upload-rate":        &limits.Upload,
+		"download-rate":      &limits.Download,
+		"peer-upload-rate":   &limits.PeerUpload,
+		"peer-download-rate": &limits.PeerDownload,
+	}
+
+	for name, rate := range rates {
+		var err error
+		*rate, err = services.ParseSize(c.String(name))
+		if err != nil {
+			return limits, err
+		}
+	}
+
+	for _, w := range c.StringSlice("window") {
+		tw, err := services.ParseTransferWindow(w)
+		if err != nil {
+			return limits, err
+		}
+
+		limits.Windows = append(limits.Windows, tw)
+	}
+
+	return limits, nil
+}
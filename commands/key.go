@@ -0,0 +1,96 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
+)
+
+//Key manages the public keys that may use git over ssh, they
+//are replicated such that a key works against any member
+var Key = cli.Command{
+	Name:  "key",
+	Usage: "manage the public keys that may push and fetch over ssh",
+	Subcommands: []cli.Command{
+		{
+			Name:  "add",
+			Usage: "authorize a public key, e.g. 'cell key add alice ~/.ssh/id_ed25519.pub'",
+			Action: func(c *cli.Context) {
+				name := c.Args().Get(0)
+				path := c.Args().Get(1)
+				if name == "" || path == "" {
+					log.Fatalf("Failed, Please provide a name and the public key file as arguments")
+				}
+
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					log.Fatalf("Failed to read public key '%s': %s", path, err)
+				}
+
+				args, err := json.Marshal(&services.AuthorizedKey{Name: name, Key: string(data)})
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				out, err := services.CallControl(controlSocket(c), "keys/add", args)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				k := &services.AuthorizedKey{}
+				err = json.Unmarshal(out, k)
+				if err != nil {
+					log.Fatalf("Failed to decode key: %s", err)
+				}
+
+				fmt.Println(k.Fingerprint)
+			},
+		},
+		{
+			Name:  "rm",
+			Usage: "revoke a public key by its fingerprint",
+			Action: func(c *cli.Context) {
+				fp := c.Args().First()
+				if fp == "" {
+					log.Fatalf("Failed, Please provide the fingerprint of the key as the first argument")
+				}
+
+				_, err := services.CallControl(controlSocket(c), "keys/remove", []byte(fp))
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "list the authorized public keys",
+			Action: func(c *cli.Context) {
+				out, err := services.CallControl(controlSocket(c), "keys", nil)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				keys := []*services.AuthorizedKey{}
+				err = json.Unmarshal(out, &keys)
+				if err != nil {
+					log.Fatalf("Failed to decode keys: %s", err)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tFINGERPRINT\tCOMMENT")
+				for _, k := range keys {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", k.Name, k.Fingerprint, k.Comment)
+				}
+
+				w.Flush()
+			},
+		},
+	},
+}
@@ -5,9 +5,11 @@ import (
 	"io"
 	"log"
 	"os"
-	"os/exec"
+	"strings"
 
 	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
 )
 
 var Pull = cli.Command{
@@ -21,16 +23,13 @@ var Pull = cli.Command{
 			log.Fatalf("failed to read Stdin: %s", err)
 		}
 
-		//there is a new torrent in the network
-		//@todo how to determine the location of the torrent directory
-		turl := buff.String()
-		tdir := "/tmp"
+		//there is a new magnet link in the network, hand
+		//it to the exchange of the running daemon
+		link := strings.TrimSpace(buff.String())
+		addr := controlSocket(c)
 
-		log.Printf("Adding .torrent file from url '%s' with dir '%s' to client...", turl, tdir)
-		cmd := exec.Command("deluge-console", "add", turl, "-p", tdir)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+		log.Printf("Handing link '%s' to daemon at '%s'...", link, addr)
+		_, err = services.CallControl(addr, "pull", []byte(link))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,131 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
+)
+
+//Repo creates repositories explicitly, which is the only way
+//when the daemon doesn't create them on push, and configures
+//how they are merged
+var Repo = cli.Command{
+	Name:  "repo",
+	Usage: "create, configure and list repositories",
+	Subcommands: []cli.Command{
+		{
+			Name:  "create",
+			Usage: "create a repository on all members, e.g. 'cell repo create team/dataset'",
+			Action: func(c *cli.Context) {
+				name := c.Args().First()
+				if name == "" {
+					log.Fatalf("Failed, Please provide the name of the repository as the first argument")
+				}
+
+				out, err := services.CallControl(controlSocket(c), "repos/create", []byte(name))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				info := &services.RepoInfo{}
+				err = json.Unmarshal(out, info)
+				if err != nil {
+					log.Fatalf("Failed to decode repository: %s", err)
+				}
+
+				fmt.Println(info.Name)
+			},
+		},
+		{
+			Name:  "strategy",
+			Usage: "set how branches that diverged on different members are merged: " + strings.Join(services.MergeStrategies(), ", ") + " or a program of 'cell join --merge-program', e.g. 'cell repo strategy team/dataset keep-both'",
+			Action: func(c *cli.Context) {
+				info := &services.RepoInfo{Name: c.Args().Get(0), Strategy: c.Args().Get(1)}
+				if info.Name == "" || info.Strategy == "" {
+					log.Fatalf("Failed, Please provide the repository and the merge strategy as arguments")
+				}
+
+				args, err := json.Marshal(info)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				_, err = services.CallControl(controlSocket(c), "repos/strategy", args)
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "log",
+			Usage: "list how branches of other members were integrated into a repository",
+			Action: func(c *cli.Context) {
+				name := c.Args().First()
+				if name == "" {
+					log.Fatalf("Failed, Please provide the name of the repository as the first argument")
+				}
+
+				out, err := services.CallControl(controlSocket(c), "repos/integrations", []byte(name))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				ins := []*services.Integration{}
+				err = json.Unmarshal(out, &ins)
+				if err != nil {
+					log.Fatalf("Failed to decode integrations: %s", err)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "TIME\tORIGIN\tBRANCH\tOUTCOME\tSTRATEGY\tRESULT\tERROR")
+				for _, in := range ins {
+					strategy := in.Strategy
+					if strategy == "" {
+						strategy = "-"
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", in.Time.Format(time.RFC3339), in.Origin, in.Branch, in.Outcome, strategy, in.Result, in.Error)
+				}
+
+				w.Flush()
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "list the repositories of this member and the ones created on any member",
+			Action: func(c *cli.Context) {
+				out, err := services.CallControl(controlSocket(c), "repos", nil)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				infos := []*services.RepoInfo{}
+				err = json.Unmarshal(out, &infos)
+				if err != nil {
+					log.Fatalf("Failed to decode repositories: %s", err)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tCREATED\tSTRATEGY")
+				for _, info := range infos {
+					created := "-"
+					if !info.Created.IsZero() {
+						created = info.Created.Format(time.RFC3339)
+					}
+
+					fmt.Fprintf(w, "%s\t%s\t%s\n", info.Name, created, info.Strategy)
+				}
+
+				w.Flush()
+			},
+		},
+	},
+}
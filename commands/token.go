@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
+)
+
+//Token manages tokens that can be used in place of a password,
+//e.g. by scripts and ci jobs
+var Token = cli.Command{
+	Name:  "token",
+	Usage: "manage tokens that authenticate as a user",
+	Subcommands: []cli.Command{
+		{
+			Name:  "create",
+			Usage: "create a token for a user and print it, it can't be shown again",
+			Action: func(c *cli.Context) {
+				user := c.Args().First()
+				if user == "" {
+					log.Fatalf("Failed, Please provide the name of the user as the first argument")
+				}
+
+				out, err := services.CallControl(controlSocket(c), "tokens/create", []byte(user))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				t := &services.Token{}
+				err = json.Unmarshal(out, t)
+				if err != nil {
+					log.Fatalf("Failed to decode token: %s", err)
+				}
+
+				fmt.Println(t.Secret)
+			},
+		},
+		{
+			Name:  "rm",
+			Usage: "revoke a token by its id",
+			Action: func(c *cli.Context) {
+				id := c.Args().First()
+				if id == "" {
+					log.Fatalf("Failed, Please provide the id of the token as the first argument")
+				}
+
+				_, err := services.CallControl(controlSocket(c), "tokens/remove", []byte(id))
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "list all tokens",
+			Action: func(c *cli.Context) {
+				out, err := services.CallControl(controlSocket(c), "tokens", nil)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				tokens := []*services.Token{}
+				err = json.Unmarshal(out, &tokens)
+				if err != nil {
+					log.Fatalf("Failed to decode tokens: %s", err)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "ID\tUSER\tCREATED")
+				for _, t := range tokens {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", t.ID, t.User, t.Created.Format(time.RFC3339))
+				}
+
+				w.Flush()
+			},
+		},
+	},
+}
@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
+)
+
+var Transfers = cli.Command{
+	Name:  "transfers",
+	Usage: "list the transfers of the running daemon",
+	Flags: []cli.Flag{
+		cli.DurationFlag{Name: "stalled", Value: time.Minute * 5, Usage: "report running transfers without progress for this long as stalled"},
+	},
+	Action: func(c *cli.Context) {
+		out, err := services.CallControl(controlSocket(c), "transfers", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ts := []services.Transfer{}
+		err = json.Unmarshal(out, &ts)
+		if err != nil {
+			log.Fatalf("Failed to decode transfers: %s", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSTATE\tCOMPLETED\tTOTAL\tPEERS\tETA\tLINK")
+		for _, t := range ts {
+			state := "running"
+			switch {
+			case t.Done:
+				state = "done"
+			case t.Error != "":
+				state = fmt.Sprintf("failed: %s", t.Error)
+			case t.Stalled(c.Duration("stalled")):
+				state = fmt.Sprintf("stalled since %s", t.Updated.Format(time.Kitchen))
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\t%s\n", t.Name, state, t.Completed, t.Total, t.Peers, t.ETA, t.Link)
+		}
+
+		w.Flush()
+	},
+}
@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+
+	"github.com/cellstate/cell/services"
+)
+
+//User manages who may push and fetch, users and acls are
+//replicated such that they apply to every member
+var User = cli.Command{
+	Name:  "user",
+	Usage: "manage the users that may push and fetch and their access to repositories",
+	Subcommands: []cli.Command{
+		{
+			Name:  "add",
+			Usage: "add a user or change its password, e.g. 'cell user add --admin alice'",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "password,p", EnvVar: "CELL_PASSWORD", Usage: "password of the user, read from stdin when not given"},
+				cli.BoolFlag{Name: "admin", Usage: "give the user access to all repositories"},
+			},
+			Action: func(c *cli.Context) {
+				name := c.Args().First()
+				if name == "" {
+					log.Fatalf("Failed, Please provide the name of the user as the first argument")
+				}
+
+				password := c.String("password")
+				if password == "" {
+					fmt.Fprintf(os.Stderr, "Password for '%s': ", name)
+					line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+					if err != nil {
+						log.Fatalf("Failed to read password: %s", err)
+					}
+
+					password = strings.TrimRight(line, "\r\n")
+				}
+
+				args, err := json.Marshal(&services.UserRequest{Name: name, Password: password, Admin: c.Bool("admin")})
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				_, err = services.CallControl(controlSocket(c), "users/add", args)
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "rm",
+			Usage: "remove a user",
+			Action: func(c *cli.Context) {
+				name := c.Args().First()
+				if name == "" {
+					log.Fatalf("Failed, Please provide the name of the user as the first argument")
+				}
+
+				_, err := services.CallControl(controlSocket(c), "users/remove", []byte(name))
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "list all users",
+			Action: func(c *cli.Context) {
+				out, err := services.CallControl(controlSocket(c), "users", nil)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				users := []*services.User{}
+				err = json.Unmarshal(out, &users)
+				if err != nil {
+					log.Fatalf("Failed to decode users: %s", err)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tADMIN")
+				for _, u := range users {
+					fmt.Fprintf(w, "%s\t%t\n", u.Name, u.Admin)
+				}
+
+				w.Flush()
+			},
+		},
+		{
+			Name:  "grant",
+			Usage: "give a user access to a repository, e.g. 'cell user grant alice my-data write', use '*' for all users",
+			Action: func(c *cli.Context) {
+				g := &services.Grant{User: c.Args().Get(0), Repo: c.Args().Get(1), Access: c.Args().Get(2)}
+				if g.User == "" || g.Repo == "" || g.Access == "" {
+					log.Fatalf("Failed, Please provide the user, the repository and 'read' or 'write' as arguments")
+				}
+
+				args, err := json.Marshal(g)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				_, err = services.CallControl(controlSocket(c), "users/grant", args)
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "revoke",
+			Usage: "take away all access of a user to a repository",
+			Action: func(c *cli.Context) {
+				g := &services.Grant{User: c.Args().Get(0), Repo: c.Args().Get(1)}
+				if g.User == "" || g.Repo == "" {
+					log.Fatalf("Failed, Please provide the user and the repository as arguments")
+				}
+
+				args, err := json.Marshal(g)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				_, err = services.CallControl(controlSocket(c), "users/revoke", args)
+				if err != nil {
+					log.Fatal(err)
+				}
+			},
+		},
+		{
+			Name:  "acl",
+			Usage: "list who has access to which repository",
+			Action: func(c *cli.Context) {
+				out, err := services.CallControl(controlSocket(c), "acls", nil)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				acls := []*services.ACL{}
+				err = json.Unmarshal(out, &acls)
+				if err != nil {
+					log.Fatalf("Failed to decode acls: %s", err)
+				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "REPO\tUSER\tACCESS")
+				for _, acl := range acls {
+					for user, access := range acl.Users {
+						fmt.Fprintf(w, "%s\t%s\t%s\n", acl.Repo, user, access)
+					}
+				}
+
+				w.Flush()
+			},
+		},
+	},
+}
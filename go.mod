@@ -0,0 +1,11 @@
+module github.com/cellstate/cell
+
+go 1.14
+
+require (
+	github.com/anacrolix/torrent v1.15.0
+	github.com/codegangsta/cli v1.9.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+)
@@ -14,11 +14,22 @@ func main() {
 	app.Usage = "make an explosive entrance"
 	app.Flags = []cli.Flag{
 		cli.StringFlag{Name: "token,t", Usage: "..."},
+		cli.StringFlag{Name: "secret", EnvVar: "CELL_SECRET", Usage: "secret shared by all members to authenticate each other, required by join"},
+		cli.StringFlag{Name: "control", Usage: "unix socket of the local control api of the daemon, 'control.sock' in the data dir by default"},
 	}
 
 	app.Commands = []cli.Command{
 		commands.Join,
 		commands.Pull,
+		commands.Event,
+		commands.Chunk,
+		commands.Transfers,
+		commands.Bench,
+		commands.GC,
+		commands.Key,
+		commands.User,
+		commands.Token,
+		commands.Repo,
 	}
 
 	app.Run(os.Args)
@@ -0,0 +1,368 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//access a user can be granted to a repository, write implies read
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+//memberUser is the user members authenticate as when they fetch from
+//each other, its password is derived from the cluster secret
+const memberUser = "cell-member"
+
+//User can push and fetch with a password or any of its tokens,
+//admins have access to all repositories and can create them
+type User struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash,omitempty"`
+	Admin bool   `json:"admin,omitempty"`
+}
+
+//UserRequest adds or replaces a user
+type UserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+}
+
+//Token authenticates as a user, only a hash of it is stored. The
+//secret is only known when the token is created
+type Token struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+	Secret  string    `json:"secret,omitempty"`
+}
+
+//ACL grants users access to a single repository, the user '*'
+//stands for every authenticated user
+type ACL struct {
+	Repo  string            `json:"repo"`
+	Users map[string]string `json:"users"`
+}
+
+//Grant changes the access of a user to a repository
+type Grant struct {
+	User   string `json:"user"`
+	Repo   string `json:"repo"`
+	Access string `json:"access,omitempty"`
+}
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewAccessControl(dir string, auth *ClusterAuth, changed func(rs *replicatedSet) error) (*accessControl, error) {
+	users, err := NewReplicatedSet("users", filepath.Join(dir, "users.json"), auth)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := NewReplicatedSet("tokens", filepath.Join(dir, "tokens.json"), auth)
+	if err != nil {
+		return nil, err
+	}
+
+	acls, err := NewReplicatedSet("acls", filepath.Join(dir, "acls.json"), auth)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessControl{
+		auth:    auth,
+		users:   users,
+		tokens:  tokens,
+		acls:    acls,
+		changed: changed,
+	}, nil
+}
+
+//access control authenticates git clients and decides what they may
+//do with a repository. Users, tokens and acls are replicated sets so
+//they are the same on every member. Until the first user is added
+//the cluster is open, as it was before access control existed
+type accessControl struct {
+	auth    *ClusterAuth
+	users   *replicatedSet
+	tokens  *replicatedSet
+	acls    *replicatedSet
+	changed func(rs *replicatedSet) error
+}
+
+//Sets returns the replicated sets access control is kept in
+func (a *accessControl) Sets() []*replicatedSet {
+	return []*replicatedSet{a.users, a.tokens, a.acls}
+}
+
+//HasUsers returns whether any user was added yet
+func (a *accessControl) HasUsers() bool {
+	return len(a.users.IDs()) > 0
+}
+
+//memberPassword is what members use to fetch from each other
+func (a *accessControl) memberPassword() string {
+	h := hmac.New(sha256.New, a.auth.secret)
+	fmt.Fprint(h, memberUser)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//memberEnv configures git to authenticate as a member
+func (a *accessControl) memberEnv() []string {
+	creds := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", memberUser, a.memberPassword())))
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		fmt.Sprintf("GIT_CONFIG_VALUE_0=Authorization: Basic %s", creds),
+	}
+}
+
+//Authenticate returns the user a request was made by, the password
+//of basic authentication may also be a token of the user. Requests
+//without valid credentials are made by no user, ok is false for them
+func (a *accessControl) Authenticate(r *http.Request) (string, bool) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return "", false
+		}
+
+		password = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if ok && name == memberUser {
+		if !hmac.Equal([]byte(password), []byte(a.memberPassword())) {
+			return "", false
+		}
+
+		return memberUser, true
+	}
+
+	u := &User{}
+	if ok && a.users.Get(name, u) && bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)) == nil {
+		return u.Name, true
+	}
+
+	t := &Token{}
+	if a.tokens.Get(tokenKey(password), t) && a.users.Get(t.User, u) {
+		return u.Name, true
+	}
+
+	return "", false
+}
+
+//Allowed returns whether a user may read or write a repository, until
+//the first user is added only members can fetch. Users are added over
+//the control socket which isn't subject to access control
+func (a *accessControl) Allowed(user, repo string, write bool) bool {
+	if user == memberUser {
+		return !write
+	}
+
+	u := &User{}
+	if a.users.Get(user, u) && u.Admin {
+		return true
+	}
+
+	acl := &ACL{}
+	if !a.acls.Get(repo, acl) {
+		return false
+	}
+
+	//a grant to '*' is for every user, never for anonymous clients
+	names := []string{user}
+	if user != "" {
+		names = append(names, "*")
+	}
+
+	for _, name := range names {
+		switch acl.Users[name] {
+		case AccessWrite:
+			return true
+		case AccessRead:
+			if !write {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//AddUser adds a user or replaces its password and admin flag
+func (a *accessControl) AddUser(req *UserRequest) error {
+	if req.Name == "" || req.Name == memberUser || req.Name == "*" || strings.ContainsAny(req.Name, ":/") {
+		return fmt.Errorf("Invalid user name '%s'", req.Name)
+	}
+
+	if req.Password == "" {
+		return fmt.Errorf("Password of user '%s' can't be empty", req.Name)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	err = a.users.Put(req.Name, &User{Name: req.Name, Hash: string(hash), Admin: req.Admin})
+	if err != nil {
+		return err
+	}
+
+	return a.changed(a.users)
+}
+
+//RemoveUser removes a user, its tokens and keys stop working with it
+func (a *accessControl) RemoveUser(name string) error {
+	ok, err := a.users.Delete(name)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("No user '%s'", name)
+	}
+
+	return a.changed(a.users)
+}
+
+//Users returns all users without their password hashes
+func (a *accessControl) Users() []*User {
+	users := []*User{}
+	for _, name := range a.users.IDs() {
+		u := &User{}
+		if a.users.Get(name, u) {
+			u.Hash = ""
+			users = append(users, u)
+		}
+	}
+
+	return users
+}
+
+//Grant gives a user read or write access to a repository
+func (a *accessControl) Grant(g *Grant) error {
+	if g.Access != AccessRead && g.Access != AccessWrite {
+		return fmt.Errorf("Unknown access '%s', expected '%s' or '%s'", g.Access, AccessRead, AccessWrite)
+	}
+
+	acl := &ACL{}
+	if !a.acls.Get(g.Repo, acl) {
+		acl = &ACL{Repo: g.Repo, Users: map[string]string{}}
+	}
+
+	acl.Users[g.User] = g.Access
+	err := a.acls.Put(g.Repo, acl)
+	if err != nil {
+		return err
+	}
+
+	return a.changed(a.acls)
+}
+
+//Revoke takes away all access of a user to a repository
+func (a *accessControl) Revoke(g *Grant) error {
+	acl := &ACL{}
+	if !a.acls.Get(g.Repo, acl) || acl.Users[g.User] == "" {
+		return fmt.Errorf("User '%s' has no access to '%s'", g.User, g.Repo)
+	}
+
+	var err error
+	delete(acl.Users, g.User)
+	if len(acl.Users) == 0 {
+		_, err = a.acls.Delete(g.Repo)
+	} else {
+		err = a.acls.Put(g.Repo, acl)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return a.changed(a.acls)
+}
+
+//ACLs returns the acls of all repositories
+func (a *accessControl) ACLs() []*ACL {
+	acls := []*ACL{}
+	for _, repo := range a.acls.IDs() {
+		acl := &ACL{}
+		if a.acls.Get(repo, acl) {
+			acls = append(acls, acl)
+		}
+	}
+
+	return acls
+}
+
+//CreateToken creates a new token for a user, the secret of the token
+//is only returned here
+func (a *accessControl) CreateToken(user string) (*Token, error) {
+	if !a.users.Get(user, &User{}) {
+		return nil, fmt.Errorf("No user '%s'", user)
+	}
+
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Token{User: user, Created: time.Now()}
+	key := tokenKey(hex.EncodeToString(secret))
+	t.ID = key[:12]
+	err = a.tokens.Put(key, t)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Secret = hex.EncodeToString(secret)
+	return t, a.changed(a.tokens)
+}
+
+//RemoveToken revokes a token by its id
+func (a *accessControl) RemoveToken(id string) error {
+	for _, key := range a.tokens.IDs() {
+		if id == "" || !strings.HasPrefix(key, id) {
+			continue
+		}
+
+		_, err := a.tokens.Delete(key)
+		if err != nil {
+			return err
+		}
+
+		return a.changed(a.tokens)
+	}
+
+	return fmt.Errorf("No token '%s'", id)
+}
+
+//Tokens returns all tokens
+func (a *accessControl) Tokens() []*Token {
+	tokens := []*Token{}
+	for _, key := range a.tokens.IDs() {
+		t := &Token{}
+		if a.tokens.Get(key, t) {
+			tokens = append(tokens, t)
+		}
+	}
+
+	return tokens
+}
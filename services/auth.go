@@ -0,0 +1,233 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//requests signed longer ago than this are rejected
+const authMaxSkew = time.Minute * 5
+
+//bodies are read into memory to sign them, larger bodies can't be signed
+const authMaxBody = 16 * 1024 * 1024
+
+func NewClusterAuth(secret string) (*ClusterAuth, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("Cluster secret can't be empty")
+	}
+
+	return &ClusterAuth{secret: []byte(secret), nonces: map[string]time.Time{}}, nil
+}
+
+//ClusterAuth signs requests between members with a secret that
+//all members share, the signature covers method, path, query, body,
+//time and a nonce such that a request can't be replayed
+type ClusterAuth struct {
+	secret []byte
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+func (a *ClusterAuth) mac(r *http.Request, ts int64, nonce, sum string) string {
+	h := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(h, "%s %s?%s %d %s %s", r.Method, r.URL.Path, r.URL.RawQuery, ts, nonce, sum)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//readBody reads the body of a request and replaces it such that
+//it can be read again
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, authMaxBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > authMaxBody {
+		return nil, fmt.Errorf("Body is larger than %d bytes", authMaxBody)
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+//Sign adds the signature header to a request
+func (a *ClusterAuth) Sign(r *http.Request) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	ts := time.Now().Unix()
+	sum := sha256.Sum256(body)
+	n, s := hex.EncodeToString(nonce), hex.EncodeToString(sum[:])
+	r.Header.Set("X-Cell-Auth", fmt.Sprintf("%d:%s:%s:%s", ts, n, s, a.mac(r, ts, n, s)))
+	return nil
+}
+
+//Verify returns whether a request was signed by a member and wasn't
+//seen before. The body isn't read up front, it is verified while the
+//handler reads it and reading fails at its end when it doesn't match
+func (a *ClusterAuth) Verify(r *http.Request) bool {
+	parts := strings.SplitN(r.Header.Get("X-Cell-Auth"), ":", 4)
+	if len(parts) != 4 {
+		return false
+	}
+
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > authMaxSkew || skew < -authMaxSkew {
+		return false
+	}
+
+	sum, err := hex.DecodeString(parts[2])
+	if err != nil || len(sum) != sha256.Size {
+		return false
+	}
+
+	if !hmac.Equal([]byte(parts[3]), []byte(a.mac(r, ts, parts[1], parts[2]))) || !a.remember(parts[1], ts) {
+		return false
+	}
+
+	if r.Body == nil || r.Body == http.NoBody {
+		empty := sha256.Sum256(nil)
+		return bytes.Equal(sum, empty[:])
+	}
+
+	r.Body = &verifiedBody{ReadCloser: r.Body, hash: sha256.New(), sum: sum}
+	return true
+}
+
+//remember records the nonce of a request, it returns false when it was
+//seen before. Nonces are forgotten when their requests are too old
+func (a *ClusterAuth) remember(nonce string, ts int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if now.Sub(a.pruned) > time.Minute {
+		for n, expires := range a.nonces {
+			if now.After(expires) {
+				delete(a.nonces, n)
+			}
+		}
+
+		a.pruned = now
+	}
+
+	if _, ok := a.nonces[nonce]; ok {
+		return false
+	}
+
+	a.nonces[nonce] = time.Unix(ts, 0).Add(authMaxSkew)
+	return true
+}
+
+//verifiedBody hashes a signed body while it is read, it fails instead
+//of ending when the body doesn't match its signature
+type verifiedBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	sum  []byte
+}
+
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(b.hash.Sum(nil), b.sum) {
+		return n, fmt.Errorf("Body doesn't match its signature")
+	}
+
+	return n, err
+}
+
+//Require only passes requests that were signed by a member
+func (a *ClusterAuth) Require(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Verify(r) {
+			http.Error(w, "Cluster authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+//Transport returns a round tripper that signs every request before
+//next performs it
+func (a *ClusterAuth) Transport(next http.RoundTripper) http.RoundTripper {
+	return &signedTransport{auth: a, next: next}
+}
+
+type signedTransport struct {
+	auth *ClusterAuth
+	next http.RoundTripper
+}
+
+func (t *signedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	err := t.auth.Sign(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.next.RoundTrip(r)
+}
+
+//Get performs a signed get request
+func (a *ClusterAuth) Get(loc string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", loc, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.Sign(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+//Post performs a signed post request
+func (a *ClusterAuth) Post(loc, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", loc, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	err = a.Sign(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClusterAuthCoversQueryAndBody(t *testing.T) {
+	auth, err := NewClusterAuth("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		loc  string
+		body string
+		ok   bool
+		read bool
+	}{
+		{loc: "/has?repo=test", body: "content", ok: true, read: true},
+		{loc: "/has?repo=other", body: "content"},
+		{loc: "/has?repo=test&commit=abc", body: "content"},
+
+		//bodies are verified while they are read
+		{loc: "/has?repo=test", body: "other content", ok: true},
+		{loc: "/has?repo=test", body: "", ok: true},
+	} {
+		r := httptest.NewRequest("POST", "/has?repo=test", strings.NewReader("content"))
+		err = auth.Sign(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v := httptest.NewRequest("POST", c.loc, strings.NewReader(c.body))
+		v.Header = r.Header
+		if auth.Verify(v) != c.ok {
+			t.Errorf("expected verification of '%s' with body '%s' to be %t", c.loc, c.body, c.ok)
+		}
+
+		if !c.ok {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(v.Body)
+		if (err == nil) != c.read || string(data) != c.body {
+			t.Errorf("expected reading body '%s' to succeed: %t, got '%s' (%v)", c.body, c.read, data, err)
+		}
+	}
+}
+
+func TestClusterAuthRejectsReplays(t *testing.T) {
+	auth, err := NewClusterAuth("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/has?repo=test", nil)
+	err = auth.Sign(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ok := range []bool{true, false} {
+		v := httptest.NewRequest("GET", "/has?repo=test", nil)
+		v.Header = r.Header
+		if auth.Verify(v) != ok {
+			t.Errorf("expected verification %d of the same request to be %t", i+1, ok)
+		}
+	}
+}
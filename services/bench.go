@@ -0,0 +1,276 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//largest payload a member serves for a single measurement
+const maxBenchSize = 1024 * 1024 * 1024
+
+//results of benches that weren't collected for this long are dropped
+const maxBenchAge = time.Hour
+
+//BenchRequest asks the listed members to measure the throughput
+//and latency to each other, the origin collects the results
+type BenchRequest struct {
+	ID      string   `json:"id"`
+	Origin  string   `json:"origin"`
+	Members []string `json:"members"`
+	Size    int64    `json:"size"`
+}
+
+//BenchResult is a single measurement of member 'From' downloading
+//from member 'To', throughput is in bytes per second
+type BenchResult struct {
+	ID         string        `json:"id"`
+	From       string        `json:"from"`
+	To         string        `json:"to"`
+	Throughput float64       `json:"bps"`
+	RTT        time.Duration `json:"rtt"`
+	Error      string        `json:"error,omitempty"`
+}
+
+func NewBench(gossip Gossip, ip net.IP, port int, auth *ClusterAuth) (*benchService, error) {
+	return &benchService{
+		gossip:  gossip,
+		ip:      ip,
+		port:    port,
+		auth:    auth,
+		benches: map[string]*bench{},
+	}, nil
+}
+
+//bench holds the results of a bench we started until they are collected
+type bench struct {
+	started  time.Time
+	expected int
+	results  []*BenchResult
+}
+
+//bench service measures pairwise throughput between members on
+//demand, every member serves random payloads for the others
+type benchService struct {
+	gossip   Gossip
+	ip       net.IP
+	port     int
+	auth     *ClusterAuth
+	listener net.Listener
+
+	mu      sync.Mutex
+	benches map[string]*bench
+}
+
+func (b *benchService) Start() error {
+	var err error
+	bind := net.JoinHostPort(b.ip.String(), strconv.Itoa(b.port))
+	b.listener, err = net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Printf("Bench service listening on '%s'...", bind)
+		err := http.Serve(b.listener, b.auth.Require(b))
+		if err != nil && !strings.Contains(err.Error(), "closed network connection") {
+			log.Printf("Bench service failed: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func (b *benchService) Stop() error {
+	return b.listener.Close()
+}
+
+//ServeHTTP writes the requested number of random bytes, only to members
+func (b *benchService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 || size > maxBenchSize {
+		http.Error(w, "Invalid payload size", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.CopyN(w, mrand.New(mrand.NewSource(time.Now().UnixNano())), size)
+}
+
+//self returns our own member in the gossip pool
+func (b *benchService) self(members []*Member) (*Member, error) {
+	for _, m := range members {
+		if m.IP() != nil && m.IP().Equal(b.ip) {
+			return m, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Not a member of the gossip pool")
+}
+
+//Run gossips a bench request, all live members take part when
+//none are listed. The request is returned with its id and members
+func (b *benchService) Run(req *BenchRequest) (*BenchRequest, error) {
+	members, err := b.gossip.Members()
+	if err != nil {
+		return nil, err
+	}
+
+	self, err := b.self(members)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 4)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ID = hex.EncodeToString(id)
+	req.Origin = self.Name
+	listed := len(req.Members)
+	if listed == 0 {
+		listed = len(members)
+	}
+
+	b.mu.Lock()
+	for id, other := range b.benches {
+		if time.Since(other.started) > maxBenchAge {
+			delete(b.benches, id)
+		}
+	}
+
+	//every member measures all others
+	b.benches[req.ID] = &bench{started: time.Now(), expected: listed * (listed - 1)}
+	b.mu.Unlock()
+
+	log.Printf("Gossip bench '%s' of %d bytes...", req.ID, req.Size)
+	err = b.gossip.EmitBench(req)
+	if err != nil {
+		return nil, err
+	}
+
+	//the event leaves the list empty to stay small, the caller
+	//needs to know which members to expect results from
+	res := *req
+	if len(res.Members) == 0 {
+		for _, m := range members {
+			res.Members = append(res.Members, m.Name)
+		}
+	}
+
+	return &res, nil
+}
+
+//Handle measures the other members of a request when we are listed,
+//measurements run one at a time so they don't share our bandwidth
+func (b *benchService) Handle(req *BenchRequest) error {
+	members, err := b.gossip.Members()
+	if err != nil {
+		return err
+	}
+
+	self, err := b.self(members)
+	if err != nil {
+		return err
+	}
+
+	listed := map[string]bool{}
+	for _, m := range members {
+		listed[m.Name] = len(req.Members) == 0
+	}
+
+	for _, name := range req.Members {
+		listed[name] = true
+	}
+
+	if !listed[self.Name] {
+		return nil
+	}
+
+	go func() {
+		for _, m := range members {
+			if m.Name == self.Name || !listed[m.Name] {
+				continue
+			}
+
+			res := b.measure(req, self, m)
+			err := b.gossip.EmitBenchResult(res)
+			if err != nil {
+				log.Printf("Failed to gossip bench result for '%s': %s", m.Name, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *benchService) measure(req *BenchRequest, self, m *Member) *BenchResult {
+	res := &BenchResult{ID: req.ID, From: self.Name, To: m.Name}
+	rtt, err := b.gossip.RTT(m.Name)
+	if err == nil {
+		res.RTT = rtt
+	}
+
+	client := &http.Client{Timeout: time.Minute * 5, Transport: b.auth.Transport(http.DefaultTransport)}
+	start := time.Now()
+	resp, err := client.Get(fmt.Sprintf("http://%s/?size=%d", net.JoinHostPort(m.IP().String(), strconv.Itoa(b.port)), req.Size))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		res.Error = fmt.Sprintf("Unexpected response: %s", resp.Status)
+		return res
+	}
+
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	res.Throughput = float64(n) / time.Since(start).Seconds()
+	log.Printf("Downloaded %d bytes from '%s' at %.0f bytes/s (rtt %s)", n, m.Name, res.Throughput, res.RTT)
+	return res
+}
+
+//Collect keeps the results of benches that we started
+func (b *benchService) Collect(res *BenchResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bn, ok := b.benches[res.ID]; ok {
+		bn.results = append(bn.results, res)
+	}
+}
+
+//Results returns the results of a bench that were collected so far,
+//the bench is forgotten once all results were returned
+func (b *benchService) Results(id string) []*BenchResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bn, ok := b.benches[id]
+	if !ok {
+		return []*BenchResult{}
+	}
+
+	if len(bn.results) >= bn.expected {
+		delete(b.benches, id)
+	}
+
+	return append([]*BenchResult{}, bn.results...)
+}
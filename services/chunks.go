@@ -0,0 +1,512 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	//the first line of every pointer file
+	ChunkPointerHeader = "cellstate-chunks v1"
+
+	//pointer files are smaller than this, larger blobs aren't read
+	maxPointerSize = 1024
+
+	//chunk boundaries are found with a rolling checksum over a window
+	//of this size, chunks average 1MiB and are bounded by min and max
+	rollWindow   = 64
+	rollSplitBit = 20
+	minChunkSize = 256 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+
+	//number of chunks that are fetched concurrently
+	chunkWorkers = 8
+)
+
+//a manifest lists at most this many refs such that it fits in a chunk,
+//files with more chunks get a tree of manifests
+var maxManifestRefs = maxChunkSize / 128
+
+//rollsum is the rolling checksum of bup (and rsync), the
+//boundaries it finds only depend on nearby content so an edit
+//somewhere in a large file only changes the chunks around it
+type rollsum struct {
+	s1, s2 uint32
+	window [rollWindow]byte
+	wofs   int
+}
+
+func newRollsum() *rollsum {
+	return &rollsum{
+		s1: rollWindow * 31,
+		s2: rollWindow * (rollWindow - 1) * 31,
+	}
+}
+
+func (rs *rollsum) roll(ch byte) {
+	drop := uint32(rs.window[rs.wofs])
+	rs.s1 += uint32(ch) - drop
+	rs.s2 += rs.s1 - rollWindow*(drop+31)
+	rs.window[rs.wofs] = ch
+	rs.wofs = (rs.wofs + 1) % rollWindow
+}
+
+//digest combines both sums like bup does, s2 alone never reaches
+//the number of bits a boundary needs with a window this small
+func (rs *rollsum) digest() uint32 {
+	return rs.s1<<16 | rs.s2&0xffff
+}
+
+func (rs *rollsum) onSplit() bool {
+	mask := uint32(1<<rollSplitBit - 1)
+	return rs.digest()&mask == mask
+}
+
+//split calls fn with every content defined chunk of r
+func split(r io.Reader, fn func(chunk []byte) error) error {
+	br := bufio.NewReader(r)
+	rs := newRollsum()
+	buf := bytes.NewBuffer(nil)
+	for {
+		ch, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		buf.WriteByte(ch)
+		rs.roll(ch)
+		if (buf.Len() >= minChunkSize && rs.onSplit()) || buf.Len() >= maxChunkSize {
+			err = fn(buf.Bytes())
+			if err != nil {
+				return err
+			}
+
+			buf = bytes.NewBuffer(nil)
+		}
+	}
+
+	if buf.Len() > 0 {
+		return fn(buf.Bytes())
+	}
+
+	return nil
+}
+
+func chunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//ChunkRef is a single chunk in a manifest, when it references a
+//nested manifest its size is that of all chunks the manifest lists
+type ChunkRef struct {
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	Manifest bool   `json:"manifest,omitempty"`
+}
+
+//ChunkPointer is committed to a repository in place of a large file,
+//it references a manifest chunk that lists the chunks of the file
+type ChunkPointer struct {
+	Size     int64
+	Manifest string
+}
+
+func (p *ChunkPointer) String() string {
+	return fmt.Sprintf("%s\nsize %d\nmanifest sha256:%s\n", ChunkPointerHeader, p.Size, p.Manifest)
+}
+
+//ParseChunkPointer parses the content of a pointer file
+func ParseChunkPointer(data []byte) (*ChunkPointer, error) {
+	p := &ChunkPointer{}
+	fields := strings.Fields(string(data))
+	if !IsChunkPointer(data) || len(fields) != 6 || fields[2] != "size" || fields[4] != "manifest" {
+		return nil, fmt.Errorf("Not a chunk pointer")
+	}
+
+	_, err := fmt.Sscanf(fields[3], "%d", &p.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Manifest = strings.TrimPrefix(fields[5], "sha256:")
+	if _, err := hex.DecodeString(p.Manifest); err != nil || len(p.Manifest) != sha256.Size*2 {
+		return nil, fmt.Errorf("Invalid manifest hash in chunk pointer")
+	}
+
+	return p, nil
+}
+
+//IsChunkPointer returns whether data looks like a pointer file
+func IsChunkPointer(data []byte) bool {
+	return len(data) < maxPointerSize && bytes.HasPrefix(data, []byte(ChunkPointerHeader))
+}
+
+func NewChunkStore(root string, client *http.Client) (*chunkStore, error) {
+	return &chunkStore{root: root, client: client}, nil
+}
+
+//chunk store keeps chunks by the sha256 of their content,
+//chunks are shared by all versions of all repositories.
+//Chunks are fetched from members with the client
+type chunkStore struct {
+	root   string
+	client *http.Client
+}
+
+func (cs *chunkStore) Path(hash string) string {
+	return filepath.Join(cs.root, hash[:2], hash)
+}
+
+func (cs *chunkStore) Has(hash string) bool {
+	_, err := os.Stat(cs.Path(hash))
+	return err == nil
+}
+
+//Write verifies and stores a chunk, chunks that exist are not rewritten
+func (cs *chunkStore) Write(hash string, data []byte) error {
+	if chunkHash(data) != hash {
+		return fmt.Errorf("Chunk content doesn't match hash '%s'", hash)
+	}
+
+	if cs.Has(hash) {
+		return nil
+	}
+
+	path := cs.Path(hash)
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.tmp", path)
+	err = ioutil.WriteFile(tmp, data, 0666)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (cs *chunkStore) Read(hash string) ([]byte, error) {
+	data, err := ioutil.ReadFile(cs.Path(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	if chunkHash(data) != hash {
+		return nil, fmt.Errorf("Chunk '%s' is corrupt", hash)
+	}
+
+	return data, nil
+}
+
+//Store splits r into chunks and returns the pointer to its manifest
+func (cs *chunkStore) Store(r io.Reader) (*ChunkPointer, error) {
+	p, manifest, err := SplitChunks(r, func(ref ChunkRef, data []byte) error {
+		return cs.Write(ref.Hash, data)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return p, cs.Write(p.Manifest, manifest)
+}
+
+//Manifest returns the chunks of the file a pointer references
+func (cs *chunkStore) Manifest(p *ChunkPointer) ([]ChunkRef, error) {
+	refs := []ChunkRef{}
+	return refs, WalkManifest(p.Manifest, cs.Read, func(ref ChunkRef) error {
+		refs = append(refs, ref)
+		return nil
+	})
+}
+
+//WriteTo writes the file a pointer references, all chunks must be present
+func (cs *chunkStore) WriteTo(p *ChunkPointer, w io.Writer) error {
+	refs, err := cs.Manifest(p)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		data, err := cs.Read(ref.Hash)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Fetch makes sure the manifest and all chunks of a pointer are
+//present, missing chunks are fetched from the sources in parallel
+func (cs *chunkStore) Fetch(p *ChunkPointer, sources []string) error {
+	if len(sources) == 0 && !cs.Has(p.Manifest) {
+		return fmt.Errorf("No sources to fetch manifest '%s' from", p.Manifest)
+	}
+
+	refs := []ChunkRef{}
+	err := WalkManifest(p.Manifest, func(hash string) ([]byte, error) {
+		err := cs.fetch(hash, sources, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		return cs.Read(hash)
+	}, func(ref ChunkRef) error {
+		refs = append(refs, ref)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	missing := make(chan int)
+	errs := make(chan error, len(refs))
+	var wg sync.WaitGroup
+	for i := 0; i < chunkWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range missing {
+				err := cs.fetch(refs[i].Hash, sources, i)
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	for i, ref := range refs {
+		if !cs.Has(ref.Hash) {
+			missing <- i
+		}
+	}
+
+	close(missing)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	log.Printf("All %d chunks of manifest '%s' are present", len(refs), p.Manifest)
+	return nil
+}
+
+//fetch gets a single chunk, the offset spreads chunks over the sources
+func (cs *chunkStore) fetch(hash string, sources []string, offset int) error {
+	if cs.Has(hash) {
+		return nil
+	}
+
+	var err error
+	for i := range sources {
+		var data []byte
+		data, err = DownloadChunk(cs.client, sources[(offset+i)%len(sources)], hash)
+		if err != nil {
+			continue
+		}
+
+		return cs.Write(hash, data)
+	}
+
+	return fmt.Errorf("Failed to fetch chunk '%s' from %d sources: %s", hash, len(sources), err)
+}
+
+//ServeHTTP serves chunks for other members, chunks can be
+//uploaded with PUT and are verified against their hash
+func (cs *chunkStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash := strings.Trim(r.URL.Path, "/")
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		http.Error(w, "Invalid chunk hash", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if !cs.Has(hash) {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.ServeFile(w, r, cs.Path(hash))
+	case "PUT":
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxChunkSize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = cs.Write(hash, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//SplitChunks splits r and calls fn for every chunk, it returns the
+//pointer and the encoded manifest that the pointer references. When
+//the file needs a tree of manifests fn is called for the nested ones
+func SplitChunks(r io.Reader, fn func(ref ChunkRef, data []byte) error) (*ChunkPointer, []byte, error) {
+	p := &ChunkPointer{}
+	refs := []ChunkRef{}
+	err := split(r, func(data []byte) error {
+		ref := ChunkRef{Hash: chunkHash(data), Size: int64(len(data))}
+		refs = append(refs, ref)
+		p.Size += ref.Size
+		return fn(ref, data)
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for len(refs) > maxManifestRefs {
+		nested := []ChunkRef{}
+		for i := 0; i < len(refs); i += maxManifestRefs {
+			end := i + maxManifestRefs
+			if end > len(refs) {
+				end = len(refs)
+			}
+
+			data, err := json.Marshal(refs[i:end])
+			if err != nil {
+				return nil, nil, err
+			}
+
+			ref := ChunkRef{Hash: chunkHash(data), Manifest: true}
+			for _, r := range refs[i:end] {
+				ref.Size += r.Size
+			}
+
+			err = fn(ref, data)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			nested = append(nested, ref)
+		}
+
+		refs = nested
+	}
+
+	manifest, err := json.Marshal(refs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.Manifest = chunkHash(manifest)
+	return p, manifest, nil
+}
+
+//WalkManifest calls fn with the chunks of a file in order, the manifest
+//and the manifests it nests are read with get
+func WalkManifest(hash string, get func(hash string) ([]byte, error), fn func(ref ChunkRef) error) error {
+	data, err := get(hash)
+	if err != nil {
+		return err
+	}
+
+	refs := []ChunkRef{}
+	err = json.Unmarshal(data, &refs)
+	if err != nil {
+		return fmt.Errorf("Invalid manifest '%s': %s", hash, err)
+	}
+
+	for _, ref := range refs {
+		if ref.Manifest {
+			err = WalkManifest(ref.Hash, get, fn)
+		} else {
+			err = fn(ref)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//DownloadChunk gets a single chunk from a chunk endpoint and verifies
+//it, the client must authenticate as a user or sign its requests
+func DownloadChunk(client *http.Client, base, hash string) ([]byte, error) {
+	resp, err := client.Get(fmt.Sprintf("%s/%s", strings.TrimRight(base, "/"), hash))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to get chunk '%s' from '%s': %s", hash, base, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxChunkSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if chunkHash(data) != hash {
+		return nil, fmt.Errorf("Chunk '%s' from '%s' doesn't match its hash", hash, base)
+	}
+
+	return data, nil
+}
+
+//UploadChunk puts a single chunk on a chunk endpoint unless it has it
+//already, like downloads it requires a client that authenticates
+func UploadChunk(client *http.Client, base, hash string, data []byte) error {
+	loc := fmt.Sprintf("%s/%s", strings.TrimRight(base, "/"), hash)
+	resp, err := client.Head(loc)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+	}
+
+	req, err := http.NewRequest("PUT", loc, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("Failed to upload chunk '%s' to '%s': %s", hash, base, resp.Status)
+	}
+
+	return nil
+}
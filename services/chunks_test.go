@@ -0,0 +1,164 @@
+package services
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+//testChunks splits data and returns the hashes of its chunks in order
+func testChunks(t *testing.T, data []byte) []string {
+	hashes := []string{}
+	total := 0
+	_, _, err := SplitChunks(bytes.NewReader(data), func(ref ChunkRef, chunk []byte) error {
+		if ref.Hash != chunkHash(chunk) || ref.Size != int64(len(chunk)) {
+			t.Errorf("chunk ref doesn't match its data")
+		}
+
+		total += len(chunk)
+		hashes = append(hashes, ref.Hash)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != len(data) {
+		t.Fatalf("expected chunks to add up to %d bytes, got %d", len(data), total)
+	}
+
+	return hashes
+}
+
+func TestSplitChunksSizes(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty"},
+		{name: "smaller than a chunk", data: []byte("cellstate")},
+		{name: "random", data: testRandom(1, 16*1024*1024)},
+		{name: "zeros", data: make([]byte, 10*1024*1024)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			sizes := []int{}
+			_, _, err := SplitChunks(bytes.NewReader(c.data), func(ref ChunkRef, chunk []byte) error {
+				sizes = append(sizes, len(chunk))
+				return nil
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, size := range sizes {
+				if size > maxChunkSize || (size < minChunkSize && i != len(sizes)-1) {
+					t.Errorf("chunk %d of %d has size %d, expected between %d and %d", i, len(sizes), size, minChunkSize, maxChunkSize)
+				}
+			}
+		})
+	}
+}
+
+func testRandom(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestSplitChunksStableAfterInsert(t *testing.T) {
+	data := testRandom(1, 16*1024*1024)
+	before := testChunks(t, data)
+	if len(before) < 4 {
+		t.Fatalf("expected random data to be split in several chunks, got %d", len(before))
+	}
+
+	for _, c := range []struct {
+		name   string
+		offset int
+	}{
+		{name: "at the start", offset: 0},
+		{name: "in the middle", offset: len(data) / 2},
+		{name: "at the end", offset: len(data)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			edited := append(append(append([]byte{}, data[:c.offset]...), []byte("inserted bytes")...), data[c.offset:]...)
+			after := testChunks(t, edited)
+
+			known := map[string]bool{}
+			for _, h := range before {
+				known[h] = true
+			}
+
+			changed := 0
+			for _, h := range after {
+				if !known[h] {
+					changed++
+				}
+			}
+
+			//only the chunk with the insert changes, at most one more
+			//when the insert moved the boundary that ended it
+			if changed < 1 || changed > 2 {
+				t.Errorf("expected 1 or 2 of %d chunks to change, got %d", len(after), changed)
+			}
+		})
+	}
+}
+
+func TestSplitChunksPointer(t *testing.T) {
+	data := testRandom(2, 3*1024*1024)
+	p, manifest, err := SplitChunks(bytes.NewReader(data), func(ref ChunkRef, chunk []byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Size != int64(len(data)) || p.Manifest != chunkHash(manifest) {
+		t.Errorf("unexpected pointer: %+v", p)
+	}
+
+	parsed, err := ParseChunkPointer([]byte(p.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *parsed != *p {
+		t.Errorf("expected parsed pointer %+v, got %+v", p, parsed)
+	}
+}
+
+func TestStoreLargeFileAsManifestTree(t *testing.T) {
+	defer func(n int) { maxManifestRefs = n }(maxManifestRefs)
+	maxManifestRefs = 2
+
+	cs, err := NewChunkStore(testDir(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testRandom(3, 8*1024*1024)
+	p, err := cs.Store(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := cs.Manifest(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs) <= maxManifestRefs {
+		t.Fatalf("expected more chunks than a single manifest lists, got %d", len(refs))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = cs.WriteTo(p, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("expected the file to be written from its manifest tree")
+	}
+}
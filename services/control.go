@@ -0,0 +1,178 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//ControlFunc handles a single call on the control api, it receives
+//the raw request body and returns the raw response body
+type ControlFunc func(args []byte) ([]byte, error)
+
+func NewControl(bind string) (*controlServer, error) {
+	bind, err := expandHome(bind)
+	if err != nil {
+		return nil, err
+	}
+
+	return &controlServer{
+		bind:  bind,
+		funcs: map[string]ControlFunc{},
+	}, nil
+}
+
+//control server exposes the running daemon to
+//cli commands on the same machine, such as the
+//ones invoked by serf event handlers. It listens
+//on a unix socket that only the user running the
+//daemon can connect to, as calls are not
+//authenticated otherwise
+type controlServer struct {
+	bind     string
+	listener net.Listener
+
+	mu    sync.Mutex
+	funcs map[string]ControlFunc
+}
+
+func (c *controlServer) Handle(name string, fn ControlFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.funcs[name] = fn
+}
+
+func (c *controlServer) Start() error {
+	err := os.MkdirAll(filepath.Dir(c.bind), 0700)
+	if err != nil {
+		return err
+	}
+
+	//the socket is created in a directory only we can enter and moved
+	//in place once its permissions are set, such that no other user
+	//can connect in between
+	tmp, err := ioutil.TempDir(filepath.Dir(c.bind), ".control")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmp)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(tmp, "control.sock"), Net: "unix"})
+	if err != nil {
+		return err
+	}
+
+	l.SetUnlinkOnClose(false)
+	err = os.Chmod(filepath.Join(tmp, "control.sock"), 0600)
+	if err == nil {
+		err = os.Rename(filepath.Join(tmp, "control.sock"), c.bind)
+	}
+
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	c.listener = l
+	go func() {
+		log.Printf("Control api listening on '%s'...", c.bind)
+		err := http.Serve(c.listener, c)
+		if err != nil && !strings.Contains(err.Error(), "closed network connection") {
+			log.Printf("Control api failed: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func (c *controlServer) Stop() error {
+	err := c.listener.Close()
+	os.Remove(c.bind)
+	return err
+}
+
+func (c *controlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Control calls must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.Trim(r.URL.Path, "/")
+	c.mu.Lock()
+	fn, ok := c.funcs[name]
+	c.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("No such control call '%s'", name), http.StatusNotFound)
+		return
+	}
+
+	args, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := fn(args)
+	if err != nil {
+		log.Printf("Control call '%s' failed: %s", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(res)
+}
+
+//CallControl invokes a control call on the daemon listening on the
+//unix socket at addr
+func CallControl(addr, name string, args []byte) ([]byte, error) {
+	addr, err := expandHome(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		},
+	}}
+
+	resp, err := client.Post(fmt.Sprintf("http://control/%s", name), "application/octet-stream", bytes.NewReader(args))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Control call '%s' failed: %s", name, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+//expandHome expands a leading '~' in a path to the home directory
+//of the user
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
+}
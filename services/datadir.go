@@ -0,0 +1,225 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//DataDirVersion is the version of the on-disk layout this build
+//writes, older layouts are migrated when the daemon starts
+const DataDirVersion = 3
+
+//migrations upgrade a data dir from the version they are keyed by
+//to the next version
+var migrations = map[int]func(d *DataDir) error{
+	1: migrateRepoNames,
+	2: migrateLFSRepos,
+}
+
+//migrateRepoNames drops the '.git' suffix of repositories and their
+//snapshots, names no longer include it such that 'my-data' and
+//'my-data.git' are the same repository
+func migrateRepoNames(d *DataDir) error {
+	for _, root := range []string{d.Repos(), d.Snapshots()} {
+		fis, err := ioutil.ReadDir(root)
+		if err != nil {
+			return err
+		}
+
+		for _, fi := range fis {
+			if !fi.IsDir() || !strings.HasSuffix(fi.Name(), ".git") {
+				continue
+			}
+
+			name := strings.TrimSuffix(fi.Name(), ".git")
+			if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+				log.Printf("Warning: not renaming '%s', '%s' exists already", fi.Name(), name)
+				continue
+			}
+
+			err := os.Rename(filepath.Join(root, fi.Name()), filepath.Join(root, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//migrateLFSRepos moves the lfs objects, that all repositories shared,
+//into every repository that references them. Downloads that didn't
+//complete are dropped, their pulls are gossiped with a repository now
+func migrateLFSRepos(d *DataDir) error {
+	objects := filepath.Join(d.LFS(), "objects")
+	repos, err := listRepos(d.Repos())
+	if err != nil {
+		return err
+	}
+
+	for _, repo := range repos {
+		err := scanPointers(filepath.Join(d.Repos(), repo), func(content []byte) error {
+			oid := lfsPointerOid(content)
+			if !validOid(oid) {
+				return nil
+			}
+
+			path := filepath.Join(objects, oid[:2], oid)
+			if _, err := os.Stat(path); err != nil {
+				return nil
+			}
+
+			dst := filepath.Join(d.LFS(), "repos", repo, oid)
+			err := os.MkdirAll(filepath.Dir(dst), 0777)
+			if err == nil {
+				err = os.Link(path, dst)
+			}
+
+			if os.IsExist(err) {
+				return nil
+			}
+
+			return err
+		})
+
+		if err != nil {
+			return fmt.Errorf("Failed to move lfs objects of '%s': %s", repo, err)
+		}
+	}
+
+	j, err := NewJournal(filepath.Join(d.Transfers(), "journal.json"))
+	if err != nil {
+		return err
+	}
+
+	for key, e := range j.entries {
+		if e.Object != nil {
+			delete(j.entries, key)
+		}
+	}
+
+	err = j.write()
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(filepath.Join(d.LFS(), "incoming"))
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(objects)
+}
+
+//NewDataDir creates and validates the data directory at root, a
+//leading '~' is expanded to the home directory of the user
+func NewDataDir(root string) (*DataDir, error) {
+	root, err := expandHome(root)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DataDir{Root: root}
+	for _, dir := range []string{d.Repos(), d.Trees(), d.Snapshots(), d.Transfers(), d.Members(), d.Chunks(), d.LFS(), d.Access()} {
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create data dir '%s': %s", dir, err)
+		}
+	}
+
+	err = d.migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	//fail early instead of on the first push
+	f, err := ioutil.TempFile(d.Root, "check_")
+	if err != nil {
+		return nil, fmt.Errorf("Data dir '%s' is not writable: %s", d.Root, err)
+	}
+
+	f.Close()
+	return d, os.Remove(f.Name())
+}
+
+//DataDir is the root of all state of a node, it is laid out as:
+//
+//  VERSION      format version of the layout
+//  repos/       bare repositories that are pushed to and replicated
+//  trees/       checked out working trees of the repositories
+//  snapshots/   bundles per repository that are exchanged
+//  transfers/   transfer journal, torrent metadata and downloads
+//  members/     gossip state to rejoin members after a restart
+//  chunks/      content defined chunks of large files
+//  lfs/         git-lfs objects per repository and their downloads
+//  access/      keys and other access state replicated between members
+//  ssh_host_key host key of the ssh server
+//  control.sock unix socket of the control api
+type DataDir struct {
+	Root string
+}
+
+func (d *DataDir) Repos() string     { return filepath.Join(d.Root, "repos") }
+func (d *DataDir) Trees() string     { return filepath.Join(d.Root, "trees") }
+func (d *DataDir) Snapshots() string { return filepath.Join(d.Root, "snapshots") }
+func (d *DataDir) Transfers() string { return filepath.Join(d.Root, "transfers") }
+func (d *DataDir) Members() string   { return filepath.Join(d.Root, "members") }
+func (d *DataDir) Chunks() string    { return filepath.Join(d.Root, "chunks") }
+func (d *DataDir) LFS() string       { return filepath.Join(d.Root, "lfs") }
+func (d *DataDir) Access() string    { return filepath.Join(d.Root, "access") }
+func (d *DataDir) Control() string   { return filepath.Join(d.Root, "control.sock") }
+
+//migrate brings the layout up to the current version, a new
+//data dir is written at the current version right away
+func (d *DataDir) migrate() error {
+	path := filepath.Join(d.Root, "VERSION")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d.writeVersion(DataDirVersion)
+	} else if err != nil {
+		return err
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("Invalid version in '%s': %s", path, err)
+	}
+
+	if version > DataDirVersion {
+		return fmt.Errorf("Data dir '%s' has version %d, this build only supports up to %d", d.Root, version, DataDirVersion)
+	}
+
+	for ; version < DataDirVersion; version++ {
+		fn, ok := migrations[version]
+		if !ok {
+			return fmt.Errorf("No migration of data dir '%s' from version %d", d.Root, version)
+		}
+
+		log.Printf("Migrating data dir '%s' from version %d to %d...", d.Root, version, version+1)
+		err = fn(d)
+		if err != nil {
+			return err
+		}
+
+		err = d.writeVersion(version + 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DataDir) writeVersion(version int) error {
+	return ioutil.WriteFile(filepath.Join(d.Root, "VERSION"), []byte(fmt.Sprintf("%d\n", version)), 0666)
+}
@@ -5,3 +5,5 @@ import (
 )
 
 var ErrUserCancelled = errors.New("User cancelled")
+var ErrAccessDenied = errors.New("Access denied")
+var ErrRepoNotFound = errors.New("Repository not found")
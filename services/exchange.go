@@ -1,274 +1,789 @@
 package services
 
 import (
-	"bytes"
-	"crypto/rand"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	mrand "math/rand"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
 )
 
-func NewDeluge(gossip Gossip, ip net.IP) (Exchange, error) {
-	return &delugeProcess{
-		torrentPath: "/tmp",
-		trackerBind: ":9000",
-		filesBind:   ":8080",
+//transfers that received nothing for this long are fetched from
+//the web seeds of members instead
+const webseedStall = time.Second * 30
+
+//peers request at most a piece at once, the rate limiters must be
+//able to hand out that many bytes in one go
+const pieceLength = 256 * 1024
+
+func NewTorrentExchange(conf ExchangeConf, gossip Gossip, ip net.IP) (Exchange, error) {
+	//only members can reach the tracker and metadata
+	tracker, err := NewTracker(net.JoinHostPort(ip.String(), strconv.Itoa(conf.TrackerPort)), time.Minute*2, conf.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := NewMetadataStore(conf.MetadataDir, net.JoinHostPort(ip.String(), strconv.Itoa(conf.MetadataPort)), conf.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	bw := conf.Bandwidth
+	if bw == nil {
+		bw = NewBandwidth(TransferLimits{})
+	}
+
+	return &torrentExchange{
+		torrentPath: conf.TorrentDir,
+		trackerPort: conf.TrackerPort,
+		tracker:     tracker,
+		peerPort:    conf.PeerPort,
+		webseedPort: conf.WebseedPort,
+		metadata:    metadata,
+		metaPort:    conf.MetadataPort,
+		auth:        conf.Auth,
 		gossip:      gossip,
 		ip:          ip,
+		bandwidth:   bw,
+		stall:       webseedStall,
+		open:        true,
+		completion:  storage.NewMapPieceCompletion(),
+		transfers:   map[string]*transfer{},
+		stop:        make(chan struct{}),
+
+		transferFeed: newTransferFeed(),
 	}, nil
 }
 
-type peer struct {
-	PeerID string `bencode:"peer id"`
-	IP     string `bencode:"ip"`
-	Port   string `bencode:"port"`
+type ExchangeConf struct {
+	TrackerPort int
+	PeerPort    int
+	TorrentDir  string
+
+	//port on which members serve completed transfers over
+	//http to other members, stalled transfers fall back to these
+	WebseedPort int
+
+	//torrent metadata is kept in this directory and served
+	//to members that present the cluster authentication
+	MetadataDir  string
+	MetadataPort int
+	Auth         *ClusterAuth
+
+	//shared with everything else the node transfers
+	Bandwidth *Bandwidth
 }
 
 type Exchange interface {
 	Start() error
 	Stop() error
 
-	Benchmark() (string, error)
 	CreateLink(name, path string) (string, error)
-	SeedLink(turl, path string) error
+	SeedLink(link, dir string) error
+
+	Pull(link, dir string) error
+	Drop(link string) error
 
-	Pull(id string) error
+	Transfers() []Transfer
+	OnComplete(fn CompleteFunc)
+	Subscribe() (<-chan Transfer, func())
 }
 
-type delugeProcess struct {
+//Transfer describes the progress of a single link
+//that is being downloaded or seeded by the exchange
+type Transfer struct {
+	Link      string        `json:"link"`
+	Name      string        `json:"name"`
+	Dir       string        `json:"dir"`
+	Completed int64         `json:"completed"`
+	Total     int64         `json:"total"`
+	Peers     int           `json:"peers"`
+	ETA       time.Duration `json:"eta"`
+	Started   time.Time     `json:"started"`
+	Updated   time.Time     `json:"updated"`
+	Done      bool          `json:"done"`
+	Error     string        `json:"error,omitempty"`
+}
+
+//Stalled returns whether a transfer that is still running
+//hasn't received any data for the given duration
+func (t Transfer) Stalled(d time.Duration) bool {
+	return !t.Done && t.Error == "" && time.Since(t.Updated) > d
+}
+
+//estimate sets the eta from the average rate since the transfer
+//started, base is the number of bytes present at the start
+func (t *Transfer) estimate(base int64) {
+	t.ETA = 0
+	done := t.Completed - base
+	elapsed := time.Since(t.Started)
+	if t.Done || done <= 0 || t.Total <= t.Completed || elapsed <= 0 {
+		return
+	}
+
+	rate := float64(done) / elapsed.Seconds()
+	t.ETA = time.Duration(float64(t.Total-t.Completed)/rate) * time.Second
+}
+
+//CompleteFunc is called once all data of a transfer is available on disk
+type CompleteFunc func(t Transfer)
+
+func newTransferFeed() *transferFeed {
+	return &transferFeed{subs: map[chan Transfer]struct{}{}}
+}
+
+//transfer feed sends updates of transfers to subscribers, updates
+//are dropped for subscribers that don't keep up
+type transferFeed struct {
+	mu   sync.Mutex
+	subs map[chan Transfer]struct{}
+}
+
+//Subscribe returns a channel that receives progress, completion and
+//failure of all transfers until the returned func is called
+func (f *transferFeed) Subscribe() (<-chan Transfer, func()) {
+	ch := make(chan Transfer, 64)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.subs[ch]; ok {
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (f *transferFeed) publish(t Transfer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- t:
+		default:
+		}
+	}
+}
+
+//a single torrent added to the client
+type transfer struct {
+	link    string
+	dir     string
+	done    bool
+	err     string
+	started time.Time
+	updated time.Time
+	base    int64
+	*torrent.Torrent
+}
+
+//torrent exchange runs a bittorrent client in-process
+type torrentExchange struct {
 	torrentPath string
-	trackerBind string
-	filesBind   string
+	trackerPort int
+	tracker     *tracker
+	peerPort    int
+	webseedPort int
+	metadata    *metadataStore
+	metaPort    int
+	auth        *ClusterAuth
 	gossip      Gossip
 	ip          net.IP
-	*os.Process
+	client      *torrent.Client
+	bandwidth   *Bandwidth
+	socket      *peerSocket
+	stall       time.Duration
+	maxConns    int
+	completion  storage.PieceCompletion
+	stop        chan struct{}
+
+	mu        sync.Mutex
+	open      bool
+	transfers map[string]*transfer
+	complete  []CompleteFunc
+
+	*transferFeed
 }
 
-func (d *delugeProcess) Start() error {
-	cmd := exec.Command("deluged", "-d", "-i", d.ip.String())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Start()
+func (e *torrentExchange) Start() error {
+	cfg := torrent.NewDefaultClientConfig()
+	cfg.DataDir = e.torrentPath
+	cfg.Seed = true
+	cfg.NoDHT = true
+	cfg.SetListenAddr(net.JoinHostPort(e.ip.String(), strconv.Itoa(e.peerPort)))
+	//the client listens on every network for the host, members
+	//only have an address of one of them
+	cfg.DisableIPv6 = e.ip.To4() != nil
+	cfg.DisableIPv4 = e.ip.To4() == nil
+	cfg.UploadRateLimiter = e.bandwidth.upload
+	cfg.DownloadRateLimiter = e.bandwidth.download
+	e.maxConns = cfg.EstablishedConnsPerTorrent
+
+	//the client can't limit single peers, with per peer rates it
+	//uses our tcp socket that wraps every connection instead of its
+	//own sockets. Without them it also speaks uTP
+	peerRates := e.bandwidth.PeerUpload > 0 || e.bandwidth.PeerDownload > 0
+	if peerRates {
+		cfg.DisableTCP = true
+		cfg.DisableUTP = true
+	}
+
+	var err error
+	e.client, err = torrent.NewClient(cfg)
 	if err != nil {
 		return err
 	}
 
-	d.Process = cmd.Process
+	if peerRates {
+		e.socket, err = listenPeers(net.JoinHostPort(e.ip.String(), strconv.Itoa(e.peerPort)), e.bandwidth)
+		if err != nil {
+			return err
+		}
 
-	//starts a super minimal bittorrent tracker that only returns peers
-	go func() {
-		torrents := map[string]map[string]peer{}
-		log.Printf("Starting tracker on '%s'...", d.trackerBind)
-		err = http.ListenAndServe(d.trackerBind, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.client.AddDialer(e.socket)
+		e.client.AddListener(e.socket)
+	}
 
-			//map[ipv6:[fe80::226:bbff:fe0a:e12b] info_hash:[?0FA??c??N???] left:[100000000] key:[B22982B1] event:[started] numwant:[200] compact:[1] no_peer_id:[1] peer_id:[-UM1870-{??qCzVB<ur] port:[40959] uploaded:[0] downloaded:[0] corrupt:[0]]
-			err := r.ParseForm()
-			if err != nil {
-				log.Printf("Failed to parse announce form data: %s", err)
+	err = e.tracker.Start()
+	if err != nil {
+		return err
+	}
+
+	err = e.metadata.Start()
+	if err != nil {
+		return err
+	}
+
+	go e.schedule()
+
+	//every node runs a tracker, they gossip peer lists with
+	//random members such that any of them can be announced to
+	go func() {
+		for {
+			select {
+			case <-e.stop:
 				return
+			case <-time.After(time.Second * 15):
 			}
 
-			host, port, err := net.SplitHostPort(r.RemoteAddr)
+			members, err := e.gossip.Members()
 			if err != nil {
-				log.Printf("Failed to parse remote host and port: %s", err)
-				return
+				log.Printf("Failed to list members for tracker sync: %s", err)
+				continue
 			}
 
-			if r.Form.Get("peer_id") == "" {
-				//@todo sometimes peer_id is empty?
-				return
+			others := []*Member{}
+			for _, m := range members {
+				if !m.IP().Equal(e.ip) {
+					others = append(others, m)
+				}
 			}
 
-			//add announcing peer to peerlist of torrent
-			log.Printf("Torrent Client (peer_id: '%s', compact: %s) announces from %s:%s, port set to %s for info_hash '%x'", r.Form.Get("peer_id"), r.Form.Get("compact"), host, port, r.Form.Get("port"), r.Form.Get("info_hash"))
-			peerlist, ok := torrents[r.Form.Get("info_hash")]
-			if !ok {
-				peerlist = map[string]peer{}
-				torrents[r.Form.Get("info_hash")] = peerlist
+			if len(others) == 0 {
+				continue
 			}
 
-			peerlist[r.Form.Get("peer_id")] = peer{
-				PeerID: r.Form.Get("peer_id"),
-				IP:     host,
-				Port:   r.Form.Get("port"),
+			m := others[mrand.Intn(len(others))]
+			err = e.tracker.Sync(fmt.Sprintf("http://%s", net.JoinHostPort(m.IP().String(), strconv.Itoa(e.trackerPort))))
+			if err != nil {
+				log.Printf("Failed to sync tracker with member '%s': %s", m.Name, err)
 			}
+		}
+	}()
 
-			peers := []peer{}
-			for _, p := range peerlist {
-				peers = append(peers, p)
-			}
+	return nil
+}
 
-			if r.Form.Get("compact") == "1" {
-				buff := bytes.NewBuffer(nil)
-				err = d.writeCompactPeers(buff, peers)
-				if err != nil {
-					log.Printf("Error: %s", err)
-					return
-				}
+//CreateLink hashes the data at path and returns a magnet link for
+//it, peers that pull the link fetch the metadata from any peer
+//that has it (BEP 9) so the link remains valid when we leave. The
+//link only carries the info hash as it is gossiped in serf events
+//which are limited to 512 bytes
+func (e *torrentExchange) CreateLink(name, path string) (string, error) {
+	log.Printf("Creating torrent metadata for '%s' of '%s'...", name, path)
+
+	private := true
+	info := metainfo.Info{PieceLength: pieceLength, Private: &private}
+	err := info.BuildFromFilePath(path)
+	if err != nil {
+		return "", err
+	}
 
-				log.Printf("compact: '% x'", buff.Bytes())
-				data := struct {
-					Peers []byte `bencode:"peers"`
-				}{
-					Peers: buff.Bytes(),
-				}
+	mi := &metainfo.MetaInfo{
+		Announce:     e.announceURL(e.ip),
+		AnnounceList: [][]string{e.trackers()},
+		UrlList:      e.webseeds(),
+		CreatedBy:    "cellstate",
+		CreationDate: time.Now().Unix(),
+	}
 
-				//encode response
-				log.Printf("Returning announce with: %+v", data)
-				w.Header().Set("Content-Type", "text/plain")
-				enc := bencode.NewEncoder(w)
-				err = enc.Encode(data)
-				if err != nil {
-					log.Printf("Failed to bencode: %s", err)
-					return
-				}
+	mi.InfoBytes, err = bencode.Marshal(info)
+	if err != nil {
+		return "", err
+	}
 
-			} else {
-				data := struct {
-					Peers []peer `bencode:"peers"`
-				}{
-					Peers: peers,
-				}
+	ih := mi.HashInfoBytes()
+	err = e.metadata.Register(mi)
+	if err != nil {
+		return "", err
+	}
 
-				//encode response
-				log.Printf("Returning announce with: %+v", data)
-				w.Header().Set("Content-Type", "text/plain")
-				enc := bencode.NewEncoder(w)
-				err = enc.Encode(data)
-				if err != nil {
-					log.Printf("Failed to bencode: %s", err)
-					return
-				}
-			}
+	return fmt.Sprintf("magnet:?xt=urn:btih:%s", ih.HexString()), nil
+}
 
-		}))
+//schedule drops all peer connections outside of the transfer
+//windows and allows them again once a window opens
+func (e *torrentExchange) schedule() {
+	for {
+		open := e.bandwidth.Open(time.Now())
+		e.mu.Lock()
+		changed := open != e.open
+		e.open = open
+		trs := []*transfer{}
+		for _, tr := range e.transfers {
+			trs = append(trs, tr)
+		}
+		e.mu.Unlock()
 
-		log.Printf("Tracker exited")
-		if err != nil {
-			log.Printf("Tracker failed: %s", err)
+		if changed {
+			log.Printf("Transfer window changed (open: %t), updating %d transfers", open, len(trs))
+			for _, tr := range trs {
+				e.schedulePeers(tr, open)
+			}
 		}
-	}()
 
-	log.Printf("Torrent files can be downloaded at: '%s'", d.filesBind)
-	go func() {
-		log.Fatal(http.ListenAndServe(d.filesBind, http.FileServer(http.Dir(d.torrentPath))))
-	}()
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
 
-	return nil
+func (e *torrentExchange) schedulePeers(tr *transfer, open bool) {
+	if open {
+		tr.SetMaxEstablishedConns(e.maxConns)
+	} else {
+		tr.SetMaxEstablishedConns(0)
+	}
 }
 
-func (d *delugeProcess) writeCompactPeers(b *bytes.Buffer, peer []peer) (err error) {
-	for _, p := range peer {
+//fetchMetadata asks all members for the metadata of an info hash
+func (e *torrentExchange) fetchMetadata(ih metainfo.Hash) *metainfo.MetaInfo {
+	members, err := e.gossip.Members()
+	if err != nil {
+		log.Printf("Failed to list members, can't fetch metadata: %s", err)
+		return nil
+	}
 
-		ip4 := net.ParseIP(p.IP).To4()
-		log.Printf("ipv4: '% x' (%s)", ip4, ip4)
-		_, err = b.Write(ip4)
-		if err != nil {
-			return err
+	for _, m := range members {
+		ip := m.IP()
+		if ip == nil || ip.Equal(e.ip) {
+			continue
 		}
 
-		port, err := strconv.Atoi(p.Port)
-		if err != nil {
-			return err
+		mi, err := e.metadata.Fetch(fmt.Sprintf("http://%s", net.JoinHostPort(ip.String(), strconv.Itoa(e.metaPort))), ih)
+		if err == nil {
+			log.Printf("Fetched metadata of '%s' from member '%s'", ih.HexString(), m.Name)
+			return mi
 		}
+	}
 
-		portBytes := []byte{byte(port >> 8), byte(port)}
+	return nil
+}
 
-		log.Printf("port: '% x' (%d)", portBytes, port)
-		_, err = b.Write(portBytes)
-		if err != nil {
-			return err
+func (e *torrentExchange) announceURL(ip net.IP) string {
+	return fmt.Sprintf("http://%s/announce", net.JoinHostPort(ip.String(), strconv.Itoa(e.trackerPort)))
+}
+
+//trackers returns the announce urls of all live members, our own first
+func (e *torrentExchange) trackers() []string {
+	urls := []string{e.announceURL(e.ip)}
+	members, err := e.gossip.Members()
+	if err != nil {
+		log.Printf("Failed to list members, only announcing to ourself: %s", err)
+		return urls
+	}
+
+	for _, m := range members {
+		ip := m.IP()
+		if ip == nil || ip.Equal(e.ip) {
+			continue
 		}
+
+		urls = append(urls, e.announceURL(ip))
 	}
-	return err
+
+	return urls
+}
+
+func (e *torrentExchange) webseedURL(ip net.IP) string {
+	return fmt.Sprintf("http://%s/seed/", net.JoinHostPort(ip.String(), strconv.Itoa(e.webseedPort)))
 }
 
-func (d *delugeProcess) CreateLink(name, path string) (string, error) {
-	tname := fmt.Sprintf("%s.torrent", name)
-	tpath := filepath.Join(d.torrentPath, tname)
-	log.Printf("Creating .torrent file of '%s' at '%s'...", path, tpath)
-	cmd := exec.Command("transmission-create", "-p", fmt.Sprintf("-t=http://%s%s/announce", d.ip.String(), d.trackerBind), "-o", tpath, path)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+//webseeds returns the web seed urls of all live members, members
+//that don't have the data (yet) simply respond with a 404
+func (e *torrentExchange) webseeds() []string {
+	urls := []string{e.webseedURL(e.ip)}
+	members, err := e.gossip.Members()
 	if err != nil {
-		return "", err
+		log.Printf("Failed to list members, only using ourself as web seed: %s", err)
+		return urls
+	}
+
+	for _, m := range members {
+		ip := m.IP()
+		if ip == nil || ip.Equal(e.ip) {
+			continue
+		}
+
+		urls = append(urls, e.webseedURL(ip))
 	}
 
-	return fmt.Sprintf("http://%s%s/%s", d.ip.String(), d.filesBind, tname), nil
+	return urls
 }
 
-func (d *delugeProcess) SeedLink(turl, path string) error {
-	log.Printf("Adding .torrent file from url '%s' with dir '%s' to client...", turl, path)
-	cmd := exec.Command("deluge-console", "add", turl, "-p", path)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func (e *torrentExchange) SeedLink(link, dir string) error {
+	log.Printf("Seeding link '%s' from dir '%s'...", link, dir)
+	return e.add(link, dir)
 }
 
-//@todo implement
-func (d *delugeProcess) Benchmark() (string, error) {
+func (e *torrentExchange) Pull(link, dir string) error {
+	log.Printf("Pulling link '%s' into dir '%s'...", link, dir)
+	return e.add(link, dir)
+}
 
-	//generate a quasi-large file
-	f, err := ioutil.TempFile("", "cell_bench_")
-	if err != nil {
-		return "", err
+//add adds the magnet link to the client with storage in the given
+//dir, existing data is verified so seeding and resuming a download
+//are the same operation
+func (e *torrentExchange) add(link, dir string) error {
+	//failed transfers are retried by adding them again
+	e.mu.Lock()
+	existing, ok := e.transfers[link]
+	active := ok && existing.err == ""
+	e.mu.Unlock()
+	if active {
+		return nil
 	}
 
-	limit := int64(100000000)
-	log.Printf("created tmp file %s, filling with '%d' random bytes...", f.Name(), limit)
-	_, err = io.Copy(f, io.LimitReader(rand.Reader, limit))
+	spec, err := torrent.TorrentSpecFromMagnetURI(link)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	//create a .torrent file and publish
-	turl, err := d.CreateLink(filepath.Base(f.Name()), f.Name())
+	//when we created or pulled the link before the metadata is known,
+	//otherwise members are asked before falling back to peers (BEP 9)
+	mi := e.metadata.Get(spec.InfoHash)
+	if mi == nil {
+		mi = e.fetchMetadata(spec.InfoHash)
+	}
+
+	if mi != nil {
+		spec = torrent.TorrentSpecFromMetaInfo(mi)
+	}
+
+	//members that joined after the torrent was created run
+	//trackers too, this keeps tracking alive when the origin leaves
+	spec.Trackers = append(spec.Trackers, e.trackers())
+	spec.Storage = storage.NewFileWithCompletion(dir, e.completion)
+	t, _, err := e.client.AddTorrentSpec(spec)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	//seed .torrent from
-	err = d.SeedLink(turl, filepath.Dir(f.Name()))
+	now := time.Now()
+	tr := &transfer{link: link, dir: dir, started: now, updated: now, Torrent: t}
+	e.mu.Lock()
+	e.transfers[link] = tr
+	open := e.open
+	e.mu.Unlock()
+
+	e.schedulePeers(tr, open)
+
+	go e.watch(tr)
+	return nil
+}
+
+//watch waits for a transfer to have all its pieces, it publishes
+//progress every second and fires the completion callbacks
+func (e *torrentExchange) watch(tr *transfer) {
+	select {
+	case <-tr.GotInfo():
+	case <-tr.Closed():
+		e.fail(tr, "Transfer was closed before its metadata was received")
+		return
+	}
+
+	//metadata that came from peers is served to members as well
+	mi := tr.Metainfo()
+	err := e.metadata.Register(&mi)
 	if err != nil {
-		return turl, err
+		log.Printf("Failed to register metadata of '%s': %s", tr.link, err)
+	}
+
+	tr.VerifyData()
+	tr.DownloadAll()
+
+	e.mu.Lock()
+	tr.base = tr.BytesCompleted()
+	last := tr.base
+	e.mu.Unlock()
+	tried := time.Time{}
+	for tr.BytesMissing() > 0 {
+		select {
+		case <-tr.Closed():
+			e.fail(tr, "Transfer was closed before it completed")
+			return
+		case <-time.After(time.Second):
+		}
+
+		e.mu.Lock()
+		if completed := tr.BytesCompleted(); completed != last {
+			last = completed
+			tr.updated = time.Now()
+		}
+
+		stalled := time.Since(tr.updated) > e.stall && time.Since(tried) > e.stall
+		e.mu.Unlock()
+
+		//no peer is seeding, members that have the data serve it
+		if stalled {
+			tried = time.Now()
+			e.fetchWebseed(tr)
+		}
+
+		e.publish(e.transfer(tr))
+	}
+
+	e.mu.Lock()
+	tr.done = true
+	tr.updated = time.Now()
+	fns := append([]CompleteFunc{}, e.complete...)
+	e.mu.Unlock()
+
+	t := e.transfer(tr)
+	log.Printf("Transfer of '%s' completed (%d bytes) into '%s'", t.Name, t.Total, t.Dir)
+	for _, fn := range fns {
+		fn(t)
 	}
 
-	return turl, nil
+	e.publish(t)
 }
 
-func (d *delugeProcess) Pull(uri string) error {
-	loc, err := url.Parse(uri)
+//fetchWebseed downloads a stalled transfer from the first member that
+//serves it as a web seed (BEP 19), the torrent client we embed doesn't
+//do this itself. Only single file torrents, snapshots, are served
+func (e *torrentExchange) fetchWebseed(tr *transfer) {
+	info := tr.Info()
+	e.mu.Lock()
+	open := e.open
+	e.mu.Unlock()
+	if info == nil || len(info.Files) > 0 || !open {
+		return
+	}
+
+	for _, u := range e.webseeds() {
+		if u == e.webseedURL(e.ip) {
+			continue
+		}
+
+		err := e.fetchFile(u+info.Name, filepath.Join(tr.dir, info.Name), info.Length)
+		if err != nil {
+			log.Printf("Failed to fetch '%s' from web seed '%s': %s", info.Name, u, err)
+			continue
+		}
+
+		//pieces are verified like any data received from peers
+		tr.VerifyData()
+		if tr.BytesMissing() == 0 {
+			log.Printf("Fetched '%s' from web seed '%s'", info.Name, u)
+			return
+		}
+	}
+}
+
+//fetchFile downloads a file from a member to path, it only replaces
+//the file once all of it was received
+func (e *torrentExchange) fetchFile(loc, path string, length int64) error {
+	resp, err := e.auth.Get(loc)
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command("deluge-console", "add", loc.String())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0777)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	tmp := fmt.Sprintf("%s.webseed", path)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+	n, err := io.Copy(f, &limitedReader{r: io.LimitReader(resp.Body, length+1), limiters: e.bandwidth.downloadFrom(resp.Request.URL.Hostname())})
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if n != length {
+		return fmt.Errorf("Expected %d bytes, received %d", length, n)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+//peerSocket listens and dials tcp for the torrent client, it limits
+//every peer connection with the per peer rates
+type peerSocket struct {
+	net.Listener
+	bandwidth *Bandwidth
+	dialer    net.Dialer
+}
+
+func listenPeers(bind string, bw *Bandwidth) (*peerSocket, error) {
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peerSocket{Listener: l, bandwidth: bw}, nil
+}
+
+func (s *peerSocket) Accept() (net.Conn, error) {
+	c, err := s.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return newLimitedConn(c, s.bandwidth), nil
+}
+
+func (s *peerSocket) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	c, err := s.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLimitedConn(c, s.bandwidth), nil
+}
+
+func (s *peerSocket) LocalAddr() net.Addr {
+	return s.Addr()
 }
 
-func (d *delugeProcess) Stop() error {
-	_, err := d.Process.Wait()
+//fail records why a transfer stopped and notifies subscribers,
+//transfers that were dropped on purpose don't fail
+func (e *torrentExchange) fail(tr *transfer, msg string) {
+	e.mu.Lock()
+	if e.transfers[tr.link] != tr {
+		e.mu.Unlock()
+		return
+	}
+
+	tr.err = msg
+	e.mu.Unlock()
+
+	log.Printf("Transfer of '%s' failed: %s", tr.link, msg)
+	e.publish(e.transfer(tr))
+}
+
+func (e *torrentExchange) transfer(tr *transfer) Transfer {
+	t := Transfer{
+		Link:  tr.link,
+		Dir:   tr.dir,
+		Peers: tr.Stats().ActivePeers,
+	}
+
+	e.mu.Lock()
+	t.Done = tr.done
+	t.Error = tr.err
+	t.Started = tr.started
+	t.Updated = tr.updated
+	base := tr.base
+	e.mu.Unlock()
+
+	if tr.Info() != nil {
+		t.Name = tr.Name()
+		t.Completed = tr.BytesCompleted()
+		t.Total = tr.Length()
+		t.estimate(base)
+	}
+
+	return t
+}
+
+func (e *torrentExchange) Transfers() []Transfer {
+	e.mu.Lock()
+	trs := []*transfer{}
+	for _, tr := range e.transfers {
+		trs = append(trs, tr)
+	}
+	e.mu.Unlock()
+
+	ts := []Transfer{}
+	for _, tr := range trs {
+		ts = append(ts, e.transfer(tr))
+	}
+
+	return ts
+}
+
+//Drop stops seeding or downloading a link, its data is left on disk
+func (e *torrentExchange) Drop(link string) error {
+	e.mu.Lock()
+	tr, ok := e.transfers[link]
+	delete(e.transfers, link)
+	e.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	log.Printf("Dropping link '%s'...", link)
+	tr.Drop()
+	return e.metadata.Remove(tr.InfoHash())
+}
+
+func (e *torrentExchange) OnComplete(fn CompleteFunc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.complete = append(e.complete, fn)
+}
+
+func (e *torrentExchange) Stop() error {
+	close(e.stop)
+	e.client.Close()
+	if e.socket != nil {
+		e.socket.Close()
+	}
+
+	err := e.metadata.Stop()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return e.tracker.Stop()
 }
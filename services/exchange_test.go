@@ -0,0 +1,132 @@
+package services
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+//testGossip is a gossip with fixed members that doesn't emit anything
+type testGossip struct {
+	members []*Member
+}
+
+func (g *testGossip) Start() error                           { return nil }
+func (g *testGossip) Stop() error                            { return nil }
+func (g *testGossip) Join(addr string) error                 { return nil }
+func (g *testGossip) Members() ([]*Member, error)            { return g.members, nil }
+func (g *testGossip) RTT(name string) (time.Duration, error) { return 0, nil }
+func (g *testGossip) EmitSnapshot(s *Snapshot) error         { return nil }
+func (g *testGossip) EmitObject(o *LFSObject) error          { return nil }
+func (g *testGossip) EmitBench(b *BenchRequest) error        { return nil }
+func (g *testGossip) EmitBenchResult(r *BenchResult) error   { return nil }
+func (g *testGossip) EmitSetUpdate(u *SetUpdate) error       { return nil }
+
+//testDir returns an empty directory that is removed after the test
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cell-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestExchangePullFromWebseed(t *testing.T) {
+	auth, err := NewClusterAuth("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the member that has the snapshot only serves it over http
+	seeds := testDir(t)
+	data := bytes.Repeat([]byte("cellstate"), 100000)
+	err = ioutil.WriteFile(filepath.Join(seeds, "repo.bundle"), data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Can't listen on a second loopback address: %s", err)
+	}
+
+	srv := &httptest.Server{Listener: l, Config: &http.Server{Handler: auth.Require(http.StripPrefix("/seed", http.FileServer(http.Dir(seeds))))}}
+	srv.Start()
+	defer srv.Close()
+
+	info := metainfo.Info{PieceLength: 256 * 1024}
+	err = info.BuildFromFilePath(filepath.Join(seeds, "repo.bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mi := &metainfo.MetaInfo{}
+	mi.InfoBytes, err = bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := testDir(t)
+	gossip := &testGossip{members: []*Member{{Name: "seed", Addr: "127.0.0.2:7946"}}}
+	conf := ExchangeConf{
+		TrackerPort: 0,
+		TorrentDir:  dir,
+		WebseedPort: l.Addr().(*net.TCPAddr).Port,
+		MetadataDir: filepath.Join(dir, "torrents"),
+		Auth:        auth,
+	}
+
+	x, err := NewTorrentExchange(conf, gossip, net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := x.(*torrentExchange)
+	e.stall = time.Millisecond * 100
+	err = e.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e.Stop()
+	err = e.metadata.Register(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan Transfer, 1)
+	e.OnComplete(func(t Transfer) { done <- t })
+	err = e.Pull("magnet:?xt=urn:btih:"+mi.HashInfoBytes().HexString(), filepath.Join(dir, "downloads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case tr := <-done:
+		if tr.Completed != int64(len(data)) {
+			t.Errorf("expected %d bytes to be completed, got %d", len(data), tr.Completed)
+		}
+	case <-time.After(time.Second * 30):
+		t.Fatal("transfer didn't complete from the web seed")
+	}
+
+	pulled, err := ioutil.ReadFile(filepath.Join(dir, "downloads", "repo.bundle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(pulled, data) {
+		t.Errorf("pulled data doesn't match the web seed")
+	}
+}
@@ -0,0 +1,368 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//a member with its estimated round trip time
+type nearMember struct {
+	*Member
+	rtt time.Duration
+}
+
+//nearest returns all other live members ordered by round trip time,
+//members for which no estimate is available are put last
+func (ac *gitServer) nearest() ([]*Member, error) {
+	members, err := ac.gossip.Members()
+	if err != nil {
+		return nil, err
+	}
+
+	near := []nearMember{}
+	for _, m := range members {
+		if m.IP() == nil || m.IP().Equal(ac.ip) {
+			continue
+		}
+
+		rtt, err := ac.gossip.RTT(m.Name)
+		if err != nil {
+			rtt = time.Hour
+		}
+
+		near = append(near, nearMember{Member: m, rtt: rtt})
+	}
+
+	sort.SliceStable(near, func(i, j int) bool { return near[i].rtt < near[j].rtt })
+	res := []*Member{}
+	for _, n := range near {
+		res = append(res, n.Member)
+	}
+
+	return res, nil
+}
+
+//fetch gets a snapshot with 'git fetch' from the nearest member that
+//has all of its refs, the origin always has them so it is tried when
+//all nearer members are still behind
+func (ac *gitServer) fetch(s *Snapshot) error {
+	if !ac.bandwidth.waitOpen(ac.stop) {
+		return fmt.Errorf("Storage stopped")
+	}
+
+	repopath := filepath.Join(ac.root, s.Repo)
+	err := ac.initRepo(s.Repo)
+	if err != nil {
+		return err
+	}
+
+	refs, err := ac.snapshotRefs(s)
+	if err != nil {
+		return err
+	}
+
+	members, err := ac.nearest()
+	if err != nil {
+		return err
+	}
+
+	before := refTips(repopath)
+	for _, m := range members {
+		remote := fmt.Sprintf("http://%s/%s", net.JoinHostPort(m.IP().String(), strconv.Itoa(ac.port)), s.Repo)
+		err = ac.fetchFrom(s, refs, repopath, remote, m.Name == s.Origin)
+		if err != nil {
+			log.Printf("Member '%s' couldn't provide snapshot '%s' of '%s': %s", m.Name, s.ID, s.Repo, err)
+			continue
+		}
+
+		log.Printf("Fetched snapshot '%s' of '%s' from member '%s'", s.ID, s.Repo, m.Name)
+		ac.imported(s, before)
+		return nil
+	}
+
+	return fmt.Errorf("None of the %d members provided snapshot '%s'", len(members), s.ID)
+}
+
+//fetchFrom fetches the branches of the origin from a member, the
+//origin has them as its own branches while other members track
+//them. They are fetched in a separate namespace first such that
+//the refs are only updated once every ref of the snapshot is present
+func (ac *gitServer) fetchFrom(s *Snapshot, refs []SnapshotRef, repopath, remote string, origin bool) error {
+	branches := fmt.Sprintf("+%s*:refs/cell/incoming/heads/*", remoteRefs(s.Origin))
+	notes := fmt.Sprintf("+%s*:refs/cell/incoming/notes/*", remoteNotes(s.Origin))
+	if origin {
+		branches = "+refs/heads/*:refs/cell/incoming/heads/*"
+		notes = "+refs/notes/*:refs/cell/incoming/notes/*"
+	}
+
+	proxy := fmt.Sprintf("http.proxy=http://%s", ac.proxy.Addr())
+	_, err := gitEnv(repopath, ac.access.memberEnv(), "-c", proxy, "fetch", "--prune", remote, branches, "+refs/tags/*:refs/cell/incoming/tags/*", notes)
+	if err != nil {
+		return err
+	}
+
+	if !hasRefs(repopath, refs) {
+		return fmt.Errorf("Remote '%s' doesn't have every ref of snapshot '%s' yet", remote, s.ID)
+	}
+
+	return ac.snapshots.Apply(s, repopath, refs)
+}
+
+//snapshotRefs returns the refs a snapshot lists, any member that knows
+//them can provide them as they have to hash to the id of the snapshot.
+//They are kept such that we can provide them as well
+func (ac *gitServer) snapshotRefs(s *Snapshot) ([]SnapshotRef, error) {
+	listing, err := ac.snapshots.Refs(s)
+	if err == nil {
+		return ParseSnapshotRefs(s.ID, listing)
+	}
+
+	members, err := ac.nearest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range members {
+		q := url.Values{"repo": {s.Repo}, "snapshot": {s.ID}}
+		resp, err := ac.client.Get(fmt.Sprintf("http://%s/refs?%s", net.JoinHostPort(m.IP().String(), strconv.Itoa(ac.port)), q.Encode()))
+		if err != nil {
+			continue
+		}
+
+		listing, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRefsSize))
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		refs, err := ac.snapshots.SaveRefs(s, listing)
+		if err != nil {
+			log.Printf("Member '%s' provided invalid refs of snapshot '%s': %s", m.Name, s.ID, err)
+			continue
+		}
+
+		return refs, nil
+	}
+
+	return nil, fmt.Errorf("None of the %d members provided the refs of snapshot '%s'", len(members), s.ID)
+}
+
+//serveRefs provides the refs of a snapshot to other members
+func (ac *gitServer) serveRefs(w http.ResponseWriter, r *http.Request) {
+	s := &Snapshot{Repo: r.URL.Query().Get("repo"), ID: r.URL.Query().Get("snapshot")}
+	if !validRepoName(s.Repo) || !validObjectName(s.ID) {
+		http.Error(w, "Invalid snapshot", http.StatusBadRequest)
+		return
+	}
+
+	listing, err := ac.snapshots.Refs(s)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Write(listing)
+}
+
+//imported is called when a snapshot made it into the repository,
+//before is what its refs pointed to prior to the import
+func (ac *gitServer) imported(s *Snapshot, before []string) {
+	err := ac.journal.Done(snapshotKey(s))
+	if err != nil {
+		log.Printf("Failed to record import of snapshot '%s' of '%s' in the journal: %s", s.ID, s.Repo, err)
+	}
+
+	ac.integrate(s)
+	repopath := filepath.Join(ac.root, s.Repo)
+	err = ac.fetchChunks(repopath, before)
+	if err != nil {
+		log.Printf("Failed to fetch chunks of snapshot '%s' of '%s': %s", s.ID, s.Repo, err)
+	}
+
+	ac.updateTree(s.Repo)
+}
+
+//refTips returns what all refs of a repository point to
+func refTips(repopath string) []string {
+	out, err := git(repopath, "for-each-ref", "--format=%(objectname)")
+	if err != nil {
+		return nil
+	}
+
+	return strings.Fields(out)
+}
+
+//fetchChunks finds the pointer files that any ref gained since the refs
+//pointed to before and fetches their chunks from all other members
+func (ac *gitServer) fetchChunks(repopath string, before []string) error {
+	revs := refTips(repopath)
+	for _, tip := range before {
+		revs = append(revs, fmt.Sprintf("^%s", tip))
+	}
+
+	cmd := exec.Command("git", "rev-list", "--objects", "--stdin")
+	cmd.Dir = repopath
+	cmd.Stdin = strings.NewReader(strings.Join(revs, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("Failed to list new objects of '%s': %s", repopath, err)
+	}
+
+	paths := map[string]string{}
+	objects := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) == 2 {
+			paths[fields[0]] = fields[1]
+			objects = append(objects, fields[0])
+		}
+	}
+
+	pointers := map[string]*ChunkPointer{}
+	err = readPointers(repopath, objects, func(oid string, content []byte) {
+		if !IsChunkPointer(content) {
+			return
+		}
+
+		p, err := ParseChunkPointer(content)
+		if err != nil {
+			log.Printf("Ignoring malformed chunk pointer '%s': %s", paths[oid], err)
+			return
+		}
+
+		pointers[paths[oid]] = p
+	})
+
+	if err != nil || len(pointers) == 0 {
+		return err
+	}
+
+	if !ac.bandwidth.waitOpen(ac.stop) {
+		return fmt.Errorf("Storage stopped")
+	}
+
+	members, err := ac.nearest()
+	if err != nil {
+		return err
+	}
+
+	sources := []string{}
+	for _, m := range members {
+		sources = append(sources, fmt.Sprintf("http://%s/chunks/", net.JoinHostPort(m.IP().String(), strconv.Itoa(ac.port))))
+	}
+
+	for path, p := range pointers {
+		log.Printf("Fetching chunks of '%s' (%d bytes)...", path, p.Size)
+		err = ac.chunks.Fetch(p, sources)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//readPointers calls fn with every blob among the objects that is small
+//enough to be a pointer file, all of them are read by a single process
+func readPointers(repopath string, objects []string, fn func(oid string, content []byte)) error {
+	if len(objects) == 0 {
+		return nil
+	}
+
+	cmd := exec.Command("git", "cat-file", "--batch-check=%(objectname) %(objecttype) %(objectsize)")
+	cmd.Dir = repopath
+	cmd.Stdin = strings.NewReader(strings.Join(objects, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	blobs := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		var oid, typ string
+		var size int64
+		_, err := fmt.Sscanf(line, "%s %s %d", &oid, &typ, &size)
+		if err == nil && typ == "blob" && size < maxPointerSize {
+			blobs = append(blobs, oid)
+		}
+	}
+
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	cmd = exec.Command("git", "cat-file", "--batch")
+	cmd.Dir = repopath
+	cmd.Stdin = strings.NewReader(strings.Join(blobs, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		var oid, typ string
+		var size int
+		_, err := fmt.Fscanf(r, "%s %s %d\n", &oid, &typ, &size)
+		if err != nil {
+			break
+		}
+
+		content := make([]byte, size+1)
+		_, err = io.ReadFull(r, content)
+		if err != nil {
+			return err
+		}
+
+		fn(oid, content[:size])
+	}
+
+	return nil
+}
+
+//startProxy serves a forward proxy on the loopback interface that git
+//fetches from members go through such that the bandwidth limits apply
+//to them. It only forwards to the http port of members
+func (ac *gitServer) startProxy() error {
+	var err error
+	ac.proxy, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	//git authenticates as the member user, its requests aren't signed
+	forward := &httputil.ReverseProxy{Director: func(r *http.Request) {}, Transport: &limitedTransport{bw: ac.bandwidth}}
+	go func() {
+		err := http.Serve(ac.proxy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Scheme != "http" || r.URL.Port() != fmt.Sprint(ac.port) {
+				http.Error(w, "Only members are proxied", http.StatusForbidden)
+				return
+			}
+
+			forward.ServeHTTP(w, r)
+		}))
+		if err != nil && !strings.Contains(err.Error(), "closed network connection") {
+			log.Printf("Fetch proxy failed: %s", err)
+		}
+	}()
+
+	return nil
+}
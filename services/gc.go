@@ -0,0 +1,466 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//files that are not referenced are only removed after this
+//long, chunks and objects are uploaded before they are committed
+const gcGracePeriod = time.Hour * 24
+
+//GCReport describes what a garbage collection run removed
+type GCReport struct {
+	Snapshots int   `json:"snapshots"`
+	Dropped   int   `json:"dropped"`
+	Chunks    int   `json:"chunks"`
+	Objects   int   `json:"objects"`
+	Freed     int64 `json:"freed"`
+}
+
+//a snapshot of a repository with its bundles and refs on disk
+type snapshotFiles struct {
+	id       string
+	paths    []string
+	modified time.Time
+}
+
+//repos returns the names of all bare repositories in the root,
+//including the ones in namespaces
+func (ac *gitServer) repos() ([]string, error) {
+	return listRepos(ac.root)
+}
+
+func listRepos(root string) ([]string, error) {
+	names := []string{}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() || path == root {
+			return nil
+		}
+
+		if !isRepo(path) {
+			return nil
+		}
+
+		names = append(names, filepath.ToSlash(strings.TrimPrefix(path, root+string(filepath.Separator))))
+		return filepath.SkipDir
+	})
+
+	return names, err
+}
+
+//GC keeps the newest snapshots of every repository and stops seeding
+//the ones all members have, chunks and lfs objects that no repository
+//references anymore are removed
+func (ac *gitServer) GC() (*GCReport, error) {
+	report := &GCReport{}
+	repos, err := ac.repos()
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := map[string]bool{}
+	for _, repo := range repos {
+		err := ac.gcSnapshots(repo, report)
+		if err != nil {
+			log.Printf("Failed to collect snapshots of '%s': %s", repo, err)
+		}
+
+		//when references can't be determined nothing may be removed
+		objects := map[string]bool{}
+		err = ac.references(filepath.Join(ac.root, repo), chunks, objects)
+		if err != nil {
+			return report, fmt.Errorf("Failed to find references in '%s': %s", repo, err)
+		}
+
+		err = ac.gcObjects(repo, objects, report)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	err = ac.gcChunks(chunks, report)
+	if err != nil {
+		return report, err
+	}
+
+	log.Printf("Garbage collection removed %d snapshots, %d chunks and %d objects (%d bytes) and dropped %d links", report.Snapshots, report.Chunks, report.Objects, report.Freed, report.Dropped)
+	return report, nil
+}
+
+//gcSnapshots removes all but the newest snapshots of a repository
+func (ac *gitServer) gcSnapshots(repo string, report *GCReport) error {
+	l := ac.snapshots.lock(repo)
+	l.Lock()
+	defer l.Unlock()
+
+	fis, err := ioutil.ReadDir(ac.snapshots.Dir(repo))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	//files are named '<id>.bundle', '<base>..<id>.bundle' or '<id>.refs'
+	byID := map[string]*snapshotFiles{}
+	for _, fi := range fis {
+		path := filepath.Join(ac.snapshots.Dir(repo), fi.Name())
+		if strings.HasSuffix(fi.Name(), ".tmp") && time.Since(fi.ModTime()) > gcGracePeriod {
+			if err := os.Remove(path); err == nil {
+				report.Freed += fi.Size()
+			}
+
+			continue
+		}
+
+		ext := filepath.Ext(fi.Name())
+		if ext != ".bundle" && ext != ".refs" {
+			continue
+		}
+
+		parts := strings.Split(strings.TrimSuffix(fi.Name(), ext), "..")
+		id := parts[len(parts)-1]
+		sf, ok := byID[id]
+		if !ok {
+			sf = &snapshotFiles{id: id}
+			byID[id] = sf
+		}
+
+		sf.paths = append(sf.paths, path)
+		if fi.ModTime().After(sf.modified) {
+			sf.modified = fi.ModTime()
+		}
+	}
+
+	snapshots := []*snapshotFiles{}
+	for _, sf := range byID {
+		snapshots = append(snapshots, sf)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].modified.After(snapshots[j].modified) })
+
+	//snapshots that are still being downloaded are left alone
+	ac.mu.Lock()
+	pending := map[string]bool{}
+	for _, ps := range ac.pending {
+		pending[ps.ID] = true
+	}
+	ac.mu.Unlock()
+
+	links := map[string]Transfer{}
+	for _, t := range ac.exchange.Transfers() {
+		if t.Dir == ac.snapshots.Dir(repo) {
+			links[t.Name] = t
+		}
+	}
+
+	for i, sf := range snapshots {
+		if pending[sf.id] || i == 0 {
+			continue
+		}
+
+		keep := i < ac.keep
+		if keep && !ac.replicated(repo, sf.id) {
+			continue
+		}
+
+		for _, path := range sf.paths {
+			if t, ok := links[filepath.Base(path)]; ok {
+				err := ac.exchange.Drop(t.Link)
+				if err != nil {
+					return err
+				}
+
+				report.Dropped++
+			}
+
+			if keep {
+				continue
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+
+			report.Freed += fi.Size()
+		}
+
+		if !keep {
+			log.Printf("Removed snapshot '%s' of '%s'", sf.id, repo)
+			report.Snapshots++
+		}
+	}
+
+	return nil
+}
+
+//replicated returns whether all other live members have every ref of
+//a snapshot, a member that can't be asked is assumed not to have them
+func (ac *gitServer) replicated(repo, id string) bool {
+	members, err := ac.nearest()
+	if err != nil {
+		return false
+	}
+
+	for _, m := range members {
+		q := url.Values{"repo": {repo}, "snapshot": {id}}
+		resp, err := ac.client.Get(fmt.Sprintf("http://%s/has?%s", net.JoinHostPort(m.IP().String(), strconv.Itoa(ac.port)), q.Encode()))
+		if err != nil {
+			return false
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return false
+		}
+	}
+
+	return true
+}
+
+//serveHas tells other members whether we have every ref of a snapshot
+func (ac *gitServer) serveHas(w http.ResponseWriter, r *http.Request) {
+	s := &Snapshot{Repo: r.URL.Query().Get("repo"), ID: r.URL.Query().Get("snapshot")}
+	if !validRepoName(s.Repo) || !validObjectName(s.ID) {
+		http.Error(w, "Invalid snapshot", http.StatusBadRequest)
+		return
+	}
+
+	listing, err := ac.snapshots.Refs(s)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	refs, err := ParseSnapshotRefs(s.ID, listing)
+	if err != nil || !hasRefs(filepath.Join(ac.root, s.Repo), refs) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+//references adds the chunks and lfs objects that pointer files in any
+//commit of the repository reference, manifests that can't be read fail
+//it as the chunks they list would look unreferenced
+func (ac *gitServer) references(repopath string, chunks, objects map[string]bool) error {
+	return scanPointers(repopath, func(content []byte) error {
+		if oid := lfsPointerOid(content); oid != "" {
+			objects[oid] = true
+		}
+
+		if !IsChunkPointer(content) {
+			return nil
+		}
+
+		p, err := ParseChunkPointer(content)
+		if err != nil {
+			return nil
+		}
+
+		read := func(hash string) ([]byte, error) {
+			chunks[hash] = true
+			return ac.chunks.Read(hash)
+		}
+
+		err = WalkManifest(p.Manifest, read, func(ref ChunkRef) error {
+			chunks[ref.Hash] = true
+			return nil
+		})
+
+		if err != nil {
+			return fmt.Errorf("Failed to read manifest '%s': %s", p.Manifest, err)
+		}
+
+		return nil
+	})
+}
+
+//scanPointers calls fn with the content of every blob in the repository
+//that is small enough to be a pointer file, it stops at the first error
+func scanPointers(repopath string, fn func(content []byte) error) error {
+	out, err := git(repopath, "cat-file", "--batch-all-objects", "--batch-check=%(objectname) %(objecttype) %(objectsize)")
+	if err != nil {
+		return err
+	}
+
+	blobs := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		var oid, typ string
+		var size int64
+		_, err := fmt.Sscanf(line, "%s %s %d", &oid, &typ, &size)
+		if err == nil && typ == "blob" && size < maxPointerSize {
+			blobs = append(blobs, oid)
+		}
+	}
+
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	//read all small blobs in a single process
+	cmd := exec.Command("git", "cat-file", "--batch")
+	cmd.Dir = repopath
+	cmd.Stdin = strings.NewReader(strings.Join(blobs, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		var oid, typ string
+		var size int
+		_, err := fmt.Fscanf(r, "%s %s %d\n", &oid, &typ, &size)
+		if err != nil {
+			break
+		}
+
+		content := make([]byte, size+1)
+		_, err = io.ReadFull(r, content)
+		if err != nil {
+			return err
+		}
+
+		err = fn(content[:size])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//lfsPointerOid returns the oid of a git-lfs pointer file, if it is one
+func lfsPointerOid(data []byte) string {
+	if !bytes.HasPrefix(data, []byte("version https://git-lfs.github.com/spec/")) {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "oid sha256:") {
+			return strings.TrimPrefix(line, "oid sha256:")
+		}
+	}
+
+	return ""
+}
+
+//gcChunks removes chunks that aren't referenced
+func (ac *gitServer) gcChunks(referenced map[string]bool, report *GCReport) error {
+	return ac.gcFiles(ac.chunks.root, referenced, func(fi os.FileInfo) {
+		report.Chunks++
+		report.Freed += fi.Size()
+	})
+}
+
+//gcObjects removes the lfs objects of a repository that it doesn't
+//reference, along with the incoming copies of objects that are in
+//the store
+func (ac *gitServer) gcObjects(repo string, referenced map[string]bool, report *GCReport) error {
+	seeding := map[string]bool{}
+	links := map[string]string{}
+	for _, t := range ac.exchange.Transfers() {
+		seeding[t.Dir] = true
+		if t.Dir == ac.lfs.Dir(repo) {
+			links[t.Name] = t.Link
+		}
+	}
+
+	//the objects of nested repositories are in directories below ours
+	fis, err := ioutil.ReadDir(ac.lfs.Dir(repo))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, fi := range fis {
+		if fi.IsDir() || referenced[fi.Name()] || time.Since(fi.ModTime()) < gcGracePeriod {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(ac.lfs.Dir(repo), fi.Name()))
+		if err != nil {
+			return err
+		}
+
+		report.Objects++
+		report.Freed += fi.Size()
+		if link, ok := links[fi.Name()]; ok {
+			ac.exchange.Drop(link)
+			report.Dropped++
+		}
+	}
+
+	fis, err = ioutil.ReadDir(filepath.Join(ac.lfs.root, "incoming", repo))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		dir := ac.lfs.Incoming(repo, fi.Name())
+		if !validOid(fi.Name()) || seeding[dir] || time.Since(fi.ModTime()) < gcGracePeriod {
+			continue
+		}
+
+		if ac.lfs.Has(repo, fi.Name()) || !referenced[fi.Name()] {
+			err := os.RemoveAll(dir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//gcFiles removes the files named by their hash under dir that are
+//not referenced and are older than the grace period
+func (ac *gitServer) gcFiles(dir string, referenced map[string]bool, removed func(fi os.FileInfo)) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if fi.IsDir() || referenced[fi.Name()] || time.Since(fi.ModTime()) < gcGracePeriod {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+
+		removed(fi)
+		return nil
+	})
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testChunkRepo commits the pointer of a file with several nested
+//manifests to a repository and ages all chunks past the grace period
+func testChunkRepo(t *testing.T, ac *gitServer) *ChunkPointer {
+	defer func(n int) { maxManifestRefs = n }(maxManifestRefs)
+	maxManifestRefs = 2
+
+	p, err := ac.chunks.Store(bytes.NewReader(testRandom(4, 8*1024*1024)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(testDir(t), "src")
+	testCommits(t, src, 1)
+	err = ioutil.WriteFile(filepath.Join(src, "large.bin"), []byte(p.String()), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = git(src, "add", "large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = git(src, "-c", "user.name=test", "-c", "user.email=test@cellstate", "commit", "-q", "-m", "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = git(ac.root, "clone", "-q", "--bare", src, filepath.Join(ac.root, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-gcGracePeriod * 2)
+	err = filepath.Walk(ac.chunks.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+
+		return os.Chtimes(path, old, old)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func testChunkCount(t *testing.T, ac *gitServer) int {
+	n := 0
+	err := filepath.Walk(ac.chunks.root, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n++
+		}
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestGCKeepsChunksOfNestedManifests(t *testing.T) {
+	ac := testServer(t)
+	testChunkRepo(t, ac)
+	before := testChunkCount(t, ac)
+
+	report, err := ac.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Chunks != 0 || testChunkCount(t, ac) != before {
+		t.Errorf("expected all %d chunks to be kept, removed %d", before, report.Chunks)
+	}
+}
+
+func TestGCRemovesNoChunksWithoutManifest(t *testing.T) {
+	ac := testServer(t)
+	p := testChunkRepo(t, ac)
+	err := os.Remove(ac.chunks.Path(p.Manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := testChunkCount(t, ac)
+	_, err = ac.GC()
+	if err == nil {
+		t.Errorf("expected gc to fail when a manifest can't be read")
+	}
+
+	if testChunkCount(t, ac) != before {
+		t.Errorf("expected no chunks to be removed when a manifest can't be read")
+	}
+}
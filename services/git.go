@@ -0,0 +1,101 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+//git runs the git cli in dir and returns its trimmed output
+func git(dir string, args ...string) (string, error) {
+	return gitEnv(dir, nil, args...)
+}
+
+//gitEnv runs git with additional environment variables, these are
+//kept out of errors such that they can carry credentials
+func gitEnv(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to run 'git %s' in '%s': %s", strings.Join(args, " "), dir, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+//initRepo creates a bare repository at repopath if it doesn't exist yet
+func initRepo(repopath string) error {
+	if _, err := os.Stat(repopath); err == nil {
+		return nil
+	}
+
+	err := os.MkdirAll(repopath, 0777)
+	if err != nil {
+		return err
+	}
+
+	_, err = git(repopath, "--bare", "init")
+	return err
+}
+
+//validObjectName returns whether name is the hex id of a git object
+func validObjectName(name string) bool {
+	_, err := hex.DecodeString(name)
+	return err == nil && len(name) == sha1.Size*2
+}
+
+//hasCommit returns whether the commit is present in the repository
+func hasCommit(repopath, commit string) bool {
+	_, err := git(repopath, "cat-file", "-e", fmt.Sprintf("%s^{commit}", commit))
+	return err == nil
+}
+
+//headCommit returns the commit HEAD points to or, when HEAD is
+//unborn, the commit of the most recently updated ref
+func headCommit(repopath string) (string, error) {
+	commit, err := git(repopath, "rev-parse", "--verify", "-q", "HEAD^{commit}")
+	if err == nil && commit != "" {
+		return commit, nil
+	}
+
+	commit, err = git(repopath, "for-each-ref", "--sort=-committerdate", "--count=1", "--format=%(objectname)", "refs/heads")
+	if err != nil {
+		return "", err
+	}
+
+	if commit == "" {
+		return "", fmt.Errorf("Repository '%s' has no commits", repopath)
+	}
+
+	return commit, nil
+}
+
+//listRefs returns the commit of every ref in the repository by name
+func listRefs(repopath string) (map[string]string, error) {
+	out, err := git(repopath, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	return refs, nil
+}
+
+//isAncestor returns whether a commit is an ancestor of another one
+func isAncestor(repopath, ancestor, commit string) bool {
+	_, err := git(repopath, "merge-base", "--is-ancestor", ancestor, commit)
+	return err == nil
+}
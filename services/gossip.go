@@ -3,10 +3,12 @@ package services
 import (
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/url"
+	"net"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
 )
 
 func NewSerf(conf SerfConf) (Gossip, error) {
@@ -20,15 +22,49 @@ type Gossip interface {
 	Stop() error
 	Join(addr string) error
 	Members() ([]*Member, error)
+	RTT(name string) (time.Duration, error)
 
-	EmitTorrent(turl string) error
+	EmitSnapshot(s *Snapshot) error
+	EmitObject(o *LFSObject) error
+	EmitBench(b *BenchRequest) error
+	EmitBenchResult(r *BenchResult) error
+	EmitSetUpdate(u *SetUpdate) error
 }
 
+var rttExp = regexp.MustCompile(`rtt: ([0-9.]+) ms`)
+
 type SerfConf struct {
 	Bind string
+
+	//name of the member, it identifies the node so it has to
+	//stay the same across restarts
+	Node string
+
+	//serf records members here to rejoin them after a restart
+	SnapshotPath string
+
+	//control socket that event handlers forward events to
+	Control string
 }
 
-type Member struct{}
+//Member is a node in the gossip pool
+type Member struct {
+	Name   string            `json:"name"`
+	Addr   string            `json:"addr"`
+	Port   int               `json:"port"`
+	Tags   map[string]string `json:"tags"`
+	Status string            `json:"status"`
+}
+
+//IP returns the unicast address of the member
+func (m *Member) IP() net.IP {
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		host = m.Addr
+	}
+
+	return net.ParseIP(host)
+}
 
 //serf process runs serf in a seperate process
 //but implements the serf interface
@@ -38,14 +74,56 @@ type serfProcess struct {
 	*os.Process
 }
 
-func (s *serfProcess) EmitTorrent(turl string) error {
-	purl, err := url.Parse(turl)
+func (s *serfProcess) EmitSnapshot(snap *Snapshot) error {
+	data, err := json.Marshal(snap)
 	if err != nil {
 		return err
 	}
 
-	ename := "new_torrent"
-	cmd := exec.Command("serf", "event", ename, purl.String())
+	return s.emit("snapshot", data)
+}
+
+func (s *serfProcess) EmitObject(o *LFSObject) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	return s.emit("lfs_object", data)
+}
+
+func (s *serfProcess) EmitBench(b *BenchRequest) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	return s.emit("bench", data)
+}
+
+func (s *serfProcess) EmitBenchResult(r *BenchResult) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return s.emit("bench_result", data)
+}
+
+func (s *serfProcess) EmitSetUpdate(u *SetUpdate) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	return s.emit("set_update", data)
+}
+
+//emit sends a user event to all members, members forward it to
+//their daemon using 'cell event'. Events are not coalesced as
+//events of the same name carry different payloads, e.g. results
+func (s *serfProcess) emit(name string, payload []byte) error {
+	cmd := exec.Command("serf", "event", "-coalesce=false", name, string(payload))
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -53,7 +131,16 @@ func (s *serfProcess) EmitTorrent(turl string) error {
 }
 
 func (s *serfProcess) Start() error {
-	cmd := exec.Command("serf", "agent", fmt.Sprintf("-bind=%s", s.conf.Bind), "-event-handler=user:new_torrent=cell pull", "-log-level=debug")
+	args := []string{"agent", fmt.Sprintf("-bind=%s", s.conf.Bind), fmt.Sprintf("-event-handler=user=cell --control=%s event", s.conf.Control), "-log-level=debug"}
+	if s.conf.Node != "" {
+		args = append(args, fmt.Sprintf("-node=%s", s.conf.Node))
+	}
+
+	if s.conf.SnapshotPath != "" {
+		args = append(args, fmt.Sprintf("-snapshot=%s", s.conf.SnapshotPath))
+	}
+
+	cmd := exec.Command("serf", args...)
 
 	//@todo find more elegant logging solution
 	cmd.Stdout = os.Stdout
@@ -81,27 +168,47 @@ func (s *serfProcess) Join(addr string) error {
 
 func (s *serfProcess) Members() ([]*Member, error) {
 	v := struct {
-		Members []*Member `json: "members"`
+		Members []*Member `json:"members"`
 	}{}
 
-	r, w := io.Pipe()
 	cmd := exec.Command("serf", "members", "-status=alive", "-format=json")
 	cmd.Stderr = os.Stderr
-	cmd.Stdout = w
-	err := cmd.Start()
+	out, err := cmd.Output()
 	if err != nil {
 		return v.Members, err
 	}
 
-	dec := json.NewDecoder(r)
-	err = dec.Decode(&v)
+	err = json.Unmarshal(out, &v)
 	if err != nil {
-		return v.Members, nil
+		return v.Members, err
 	}
 
 	return v.Members, nil
 }
 
+//RTT estimates the round trip time to a member using the
+//network coordinates that serf maintains
+func (s *serfProcess) RTT(name string) (time.Duration, error) {
+	cmd := exec.Command("serf", "rtt", name)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	m := rttExp.FindSubmatch(out)
+	if m == nil {
+		return 0, fmt.Errorf("Unexpected serf rtt output: %s", out)
+	}
+
+	ms, err := strconv.ParseFloat(string(m[1]), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
+
 func (s *serfProcess) Stop() error {
 	//@todo figure out how the serf process
 	//receives the main routines interrupt
@@ -0,0 +1,302 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//outcomes of integrating a branch of another member
+const (
+	IntegrationCreated     = "created"
+	IntegrationUpToDate    = "up-to-date"
+	IntegrationFastForward = "fast-forward"
+	IntegrationMerged      = "merged"
+	IntegrationConflict    = "conflict"
+)
+
+//integrations are recorded in the bare repository, git ignores it
+const integrationLog = "integrations.log"
+
+//number of times integrating a branch is retried when a push
+//changes it at the same time
+const integrateAttempts = 3
+
+var originExp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+//validOrigin returns whether an origin can be used in ref names
+func validOrigin(origin string) bool {
+	return originExp.MatchString(origin)
+}
+
+//remoteRefs returns the ref prefix under which the branches of
+//a member are tracked
+func remoteRefs(origin string) string {
+	return fmt.Sprintf("refs/remotes/%s/", origin)
+}
+
+//remoteNotes returns the ref prefix under which the notes of a
+//member are tracked
+func remoteNotes(origin string) string {
+	return fmt.Sprintf("refs/notes/remotes/%s/", origin)
+}
+
+//memberEnv returns the environment of git commands that create
+//commits as a member, at a given time
+func memberEnv(t time.Time) []string {
+	date := fmt.Sprintf("%d +0000", t.Unix())
+	return []string{
+		fmt.Sprintf("GIT_AUTHOR_NAME=%s", mergeName),
+		fmt.Sprintf("GIT_AUTHOR_EMAIL=%s", mergeEmail),
+		fmt.Sprintf("GIT_AUTHOR_DATE=%s", date),
+		fmt.Sprintf("GIT_COMMITTER_NAME=%s", mergeName),
+		fmt.Sprintf("GIT_COMMITTER_EMAIL=%s", mergeEmail),
+		fmt.Sprintf("GIT_COMMITTER_DATE=%s", date),
+	}
+}
+
+//notePushed records that commits were pushed to this member unless
+//another member recorded them first, the notes of members are
+//combined when they are integrated
+func (ac *gitServer) notePushed(repopath string, commits []string) {
+	ac.notesMu.Lock()
+	defer ac.notesMu.Unlock()
+	for _, commit := range commits {
+		if len(pushedTo(repopath, commit)) > 0 {
+			continue
+		}
+
+		_, err := gitEnv(repopath, memberEnv(time.Now()), "notes", "--ref", originNotes, "add", "-m", ac.node, commit)
+		if err != nil {
+			log.Printf("Failed to note that '%s' was pushed here: %s", commit, err)
+		}
+	}
+}
+
+//integrateNotes combines the notes of the origin of a snapshot with
+//ours, notes of the same commit keep the lines of both
+func (ac *gitServer) integrateNotes(repopath, origin string) error {
+	ref := remoteNotes(origin) + strings.TrimPrefix(originNotes, "refs/notes/")
+	if _, err := git(repopath, "rev-parse", "--verify", "-q", ref); err != nil {
+		return nil
+	}
+
+	ac.notesMu.Lock()
+	defer ac.notesMu.Unlock()
+	_, err := gitEnv(repopath, memberEnv(time.Now()), "notes", "--ref", originNotes, "merge", "-q", "-s", "cat_sort_uniq", ref)
+	return err
+}
+
+//Integration records how a branch of another member was integrated
+//into the local branch of the same name
+type Integration struct {
+	Repo     string    `json:"repo"`
+	Origin   string    `json:"origin"`
+	Branch   string    `json:"branch"`
+	Local    string    `json:"local,omitempty"`
+	Remote   string    `json:"remote"`
+	Result   string    `json:"result,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Strategy string    `json:"strategy,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+//integrate brings the local branches up to date with the tracking
+//branches of the origin of a snapshot that was imported. Merges are
+//published such that members that don't merge the same commits
+//themselves get them
+func (ac *gitServer) integrate(s *Snapshot) {
+	repopath := filepath.Join(ac.root, s.Repo)
+	err := ac.integrateNotes(repopath, s.Origin)
+	if err != nil {
+		log.Printf("Failed to integrate notes of '%s' from '%s': %s", s.Repo, s.Origin, err)
+	}
+
+	refs, err := listRefs(repopath)
+	if err != nil {
+		log.Printf("Failed to list refs of '%s': %s", s.Repo, err)
+		return
+	}
+
+	merged := false
+	prefix := remoteRefs(s.Origin)
+	for ref, remote := range refs {
+		if !strings.HasPrefix(ref, prefix) {
+			continue
+		}
+
+		in := ac.integrateBranch(repopath, &Integration{Repo: s.Repo, Origin: s.Origin, Branch: strings.TrimPrefix(ref, prefix), Remote: remote})
+		if in.Outcome == IntegrationUpToDate {
+			continue
+		}
+
+		log.Printf("Integrated branch '%s' of '%s' from '%s': %s", in.Branch, in.Repo, in.Origin, in.Outcome)
+		err := ac.record(repopath, in)
+		if err != nil {
+			log.Printf("Failed to record integration of '%s': %s", in.Repo, err)
+		}
+
+		merged = merged || in.Outcome == IntegrationMerged
+	}
+
+	if merged {
+		ac.queuePublish(s.Repo, repopath)
+	}
+}
+
+//integrateBranch fast-forwards the local branch to the remote one or
+//merges them when they diverged, the branch is only updated when
+//nothing else updated it in the meantime
+func (ac *gitServer) integrateBranch(repopath string, in *Integration) *Integration {
+	ref := fmt.Sprintf("refs/heads/%s", in.Branch)
+	for i := 0; i < integrateAttempts; i++ {
+		in.Time = time.Now()
+		in.Local, _ = git(repopath, "rev-parse", "--verify", "-q", ref)
+		old := in.Local
+		switch {
+		case in.Local == "":
+			in.Outcome = IntegrationCreated
+			in.Result = in.Remote
+			old = zeroID
+		case in.Local == in.Remote || isAncestor(repopath, in.Remote, in.Local):
+			in.Outcome = IntegrationUpToDate
+			in.Result = in.Local
+			return in
+		case isAncestor(repopath, in.Local, in.Remote):
+			in.Outcome = IntegrationFastForward
+			in.Result = in.Remote
+		default:
+			merged, err := ac.merge(repopath, in)
+			if err != nil {
+				in.Outcome = IntegrationConflict
+				in.Result = in.Local
+				in.Error = err.Error()
+				return in
+			}
+
+			in.Outcome = IntegrationMerged
+			in.Result = merged
+		}
+
+		_, err := git(repopath, "update-ref", "-m", fmt.Sprintf("cell: %s with %s", in.Outcome, in.Origin), ref, in.Result, old)
+		if err == nil {
+			return in
+		}
+
+		log.Printf("Branch '%s' of '%s' changed while integrating, retrying...", in.Branch, in.Repo)
+	}
+
+	in.Outcome = IntegrationConflict
+	in.Result = in.Local
+	in.Error = "Branch kept changing while integrating"
+	return in
+}
+
+//merge merges both sides without a working tree with the strategy of
+//the repository. The commits that diverged are merged one by one in
+//the order they were written and each merge commit only depends on
+//its sides, such that members that merge the same commits on their
+//own create the same commits and converge, whichever they saw first
+func (ac *gitServer) merge(repopath string, in *Integration) (string, error) {
+	in.Strategy = ac.strategy(in.Repo)
+	strategy, err := mergeStrategy(in.Strategy)
+	if err != nil {
+		return "", err
+	}
+
+	tips, err := mergeTips(repopath, in.Local, in.Remote)
+	if err != nil {
+		return "", err
+	}
+
+	merged := tips[0]
+	for _, tip := range tips[1:] {
+		m := &Merge{Repo: in.Repo, Branch: in.Branch, First: merged, Second: tip}
+		commit, err := ac.mergeCommit(repopath, in, strategy, m)
+		if err != nil {
+			return "", err
+		}
+
+		merged, err = mergeSide(repopath, commit)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return merged.Commit, nil
+}
+
+//mergeCommit creates the commit of a merge, when the strategy fails to
+//merge the fallback strategy resolves the conflicts instead such that
+//the branch doesn't stay diverged
+func (ac *gitServer) mergeCommit(repopath string, in *Integration, strategy MergeStrategy, m *Merge) (string, error) {
+	name := in.Strategy
+	tree, err := strategy(repopath, m)
+	if err != nil && name != FallbackMergeStrategy {
+		in.Error = fmt.Sprintf("%s, resolved with '%s'", err, FallbackMergeStrategy)
+		name = FallbackMergeStrategy
+		tree, err = resolveWith(keepBoth)(repopath, m)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	msg := fmt.Sprintf("Merge branch '%s' at %s and %s\n\nStrategy: %s", in.Branch, m.First.Short(), m.Second.Short(), name)
+	return gitEnv(repopath, memberEnv(m.Second.Time), "commit-tree", tree, "-p", m.First.Commit, "-p", m.Second.Commit, "-m", msg)
+}
+
+//record appends an integration to the log of the repository
+func (ac *gitServer) record(repopath string, in *Integration) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(repopath, integrationLog), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\n", data)
+	return err
+}
+
+//Integrations returns the recorded integrations of a repository,
+//oldest first
+func (ac *gitServer) Integrations(repo string) ([]*Integration, error) {
+	repo, err := ParseRepoName(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	ins := []*Integration{}
+	f, err := os.Open(filepath.Join(ac.root, repo, integrationLog))
+	if os.IsNotExist(err) {
+		return ins, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		in := &Integration{}
+		err := json.Unmarshal(scanner.Bytes(), in)
+		if err != nil {
+			return nil, err
+		}
+
+		ins = append(ins, in)
+	}
+
+	return ins, scanner.Err()
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+//JournalEntry is a snapshot or lfs object that is being pulled
+type JournalEntry struct {
+	Snapshot *Snapshot  `json:"snapshot,omitempty"`
+	Object   *LFSObject `json:"object,omitempty"`
+	Added    time.Time  `json:"added"`
+}
+
+func snapshotKey(s *Snapshot) string {
+	return fmt.Sprintf("snapshot/%s/%s", s.Repo, s.ID)
+}
+
+func objectKey(o *LFSObject) string {
+	return fmt.Sprintf("object/%s/%s", o.Repo, o.Oid)
+}
+
+func NewJournal(path string) (*journal, error) {
+	j := &journal{
+		path:    path,
+		entries: map[string]*JournalEntry{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &j.entries)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read transfer journal '%s': %s", path, err)
+	}
+
+	return j, nil
+}
+
+//journal records pulls until their data is imported such that
+//they can be resumed when the daemon restarts in the middle
+type journal struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*JournalEntry
+}
+
+//Add records a pull, adding a pull that is recorded already is a no-op
+func (j *journal) Add(key string, e *JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.entries[key]; ok {
+		return nil
+	}
+
+	e.Added = time.Now()
+	j.entries[key] = e
+	return j.write()
+}
+
+//Has returns whether a pull is recorded
+func (j *journal) Has(key string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.entries[key]
+	return ok
+}
+
+//Done removes a pull once its data was imported
+func (j *journal) Done(key string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.entries[key]; !ok {
+		return nil
+	}
+
+	delete(j.entries, key)
+	return j.write()
+}
+
+//Entries returns all pulls that haven't been imported yet
+func (j *journal) Entries() []*JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := []*JournalEntry{}
+	for _, e := range j.entries {
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+//write replaces the journal on disk, the rename makes sure
+//a crash never leaves a partially written journal
+func (j *journal) write() error {
+	data, err := json.Marshal(j.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.tmp", j.path)
+	err = ioutil.WriteFile(tmp, data, 0666)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, j.path)
+}
@@ -0,0 +1,438 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//LFSObject announces a large file that was pushed to a repository of
+//a member with git-lfs, the link is empty when it should be fetched
+//over http
+type LFSObject struct {
+	Repo string `json:"repo,omitempty"`
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+	Link string `json:"link,omitempty"`
+}
+
+//lfs batch request and response, see:
+//https://github.com/git-lfs/git-lfs/blob/master/docs/api/batch.md
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers"`
+	Objects   []*LFSObject `json:"objects"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lfsBatchObject struct {
+	Oid           string                `json:"oid"`
+	Size          int64                 `json:"size"`
+	Authenticated bool                  `json:"authenticated"`
+	Actions       map[string]*lfsAction `json:"actions,omitempty"`
+	Error         *lfsError             `json:"error,omitempty"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string            `json:"transfer"`
+	Objects  []*lfsBatchObject `json:"objects"`
+}
+
+const lfsContentType = "application/vnd.git-lfs+json"
+
+func validOid(oid string) bool {
+	_, err := hex.DecodeString(oid)
+	return err == nil && len(oid) == sha256.Size*2
+}
+
+func NewLFSStore(root string) (*lfsStore, error) {
+	return &lfsStore{root: root}, nil
+}
+
+//lfs store keeps the objects of every repository apart by their oid,
+//knowing the oid of an object in one repository doesn't give access
+//to it through another one. Objects only appear in it after their
+//content was verified. The exchange downloads into a separate
+//incoming directory
+type lfsStore struct {
+	root string
+}
+
+func (ls *lfsStore) Dir(repo string) string {
+	return filepath.Join(ls.root, "repos", repo)
+}
+
+func (ls *lfsStore) Path(repo, oid string) string {
+	return filepath.Join(ls.Dir(repo), oid)
+}
+
+//Incoming returns the directory the exchange downloads an object into
+func (ls *lfsStore) Incoming(repo, oid string) string {
+	return filepath.Join(ls.root, "incoming", repo, oid)
+}
+
+func (ls *lfsStore) Has(repo, oid string) bool {
+	_, err := os.Stat(ls.Path(repo, oid))
+	return err == nil
+}
+
+//Write stores the content of r when it matches the oid, a negative
+//size is not checked and set to the number of bytes that were read
+func (ls *lfsStore) Write(o *LFSObject, r io.Reader) error {
+	if ls.Has(o.Repo, o.Oid) {
+		return nil
+	}
+
+	err := os.MkdirAll(ls.Dir(o.Repo), 0777)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(ls.Dir(o.Repo), "upload_")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != o.Oid || (o.Size >= 0 && n != o.Size) {
+		return fmt.Errorf("Content of object '%s' doesn't match its oid or size", o.Oid)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	o.Size = n
+	return os.Rename(f.Name(), ls.Path(o.Repo, o.Oid))
+}
+
+//Import verifies an object the exchange downloaded to path and links
+//it into the store, the file stays in place so it can be seeded
+func (ls *lfsStore) Import(o *LFSObject, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != o.Oid {
+		os.RemoveAll(filepath.Dir(path))
+		return fmt.Errorf("Downloaded object '%s' doesn't match its oid", o.Oid)
+	}
+
+	err = os.MkdirAll(ls.Dir(o.Repo), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = os.Link(path, ls.Path(o.Repo, o.Oid))
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+//serveLFS implements the lfs batch api and basic transfers for the
+//repository name at prefix, every repository has its own objects
+func (ac *gitServer) serveLFS(w http.ResponseWriter, r *http.Request, name, prefix, path string) {
+	if path == "objects/batch" && r.Method == "POST" {
+		ac.serveLFSBatch(w, r, name, prefix)
+		return
+	}
+
+	oid := strings.TrimPrefix(path, "objects/")
+	if !strings.HasPrefix(path, "objects/") || !validOid(oid) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		ac.serveLFSObject(w, r, name, oid)
+	case "PUT":
+		o := &LFSObject{Repo: name, Oid: oid, Size: r.ContentLength}
+		err := ac.lfs.Write(o, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		log.Printf("Received lfs object '%s' of '%s' (%d bytes), publishing...", o.Oid, o.Repo, o.Size)
+		err = ac.publishObject(o)
+		if err != nil {
+			log.Printf("Failed to publish lfs object '%s' of '%s': %s", o.Oid, o.Repo, err)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ac *gitServer) serveLFSBatch(w http.ResponseWriter, r *http.Request, name, prefix string) {
+	req := &lfsBatchRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Operation != "upload" && req.Operation != "download" {
+		http.Error(w, fmt.Sprintf("Unsupported operation '%s'", req.Operation), http.StatusUnprocessableEntity)
+		return
+	}
+
+	user, ok := ac.access.Authenticate(r)
+	if req.Operation == "upload" && (!ok || !ac.access.Allowed(user, name, true)) {
+		ac.deny(w, user)
+		return
+	}
+
+	//transfers authenticate with the credentials of the batch request
+	header := map[string]string{}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		header["Authorization"] = auth
+	}
+
+	res := &lfsBatchResponse{Transfer: "basic", Objects: []*lfsBatchObject{}}
+	for _, o := range req.Objects {
+		bo := &lfsBatchObject{Oid: o.Oid, Size: o.Size, Authenticated: len(header) > 0}
+		res.Objects = append(res.Objects, bo)
+		if !validOid(o.Oid) {
+			bo.Error = &lfsError{Code: http.StatusUnprocessableEntity, Message: "Invalid oid"}
+			continue
+		}
+
+		//objects that are still being pulled are fetched from other
+		//members when downloaded, uploads of objects we have are skipped
+		href := fmt.Sprintf("http://%s%s/info/lfs/objects/%s", r.Host, prefix, o.Oid)
+		has := ac.lfs.Has(name, o.Oid)
+		if req.Operation == "download" && !has && !ac.journal.Has(objectKey(&LFSObject{Repo: name, Oid: o.Oid})) {
+			bo.Error = &lfsError{Code: http.StatusNotFound, Message: "Object doesn't exist"}
+		} else if req.Operation == "download" {
+			bo.Actions = map[string]*lfsAction{"download": {Href: href, Header: header}}
+		} else if !has {
+			bo.Actions = map[string]*lfsAction{"upload": {Href: href, Header: header}}
+		}
+	}
+
+	w.Header().Set("Content-Type", lfsContentType)
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		log.Printf("Failed to write lfs batch response: %s", err)
+	}
+}
+
+func objectPath(repo, oid string) string {
+	return fmt.Sprintf("/lfs/objects/%s/%s", repo, oid)
+}
+
+//serveLocalObject serves objects to other members, it never
+//fetches such that members don't keep asking each other
+func (ac *gitServer) serveLocalObject(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/lfs/objects/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 || !validRepoName(path[:i]) || !validOid(path[i+1:]) || !ac.lfs.Has(path[:i], path[i+1:]) {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeFile(w, r, ac.lfs.Path(path[:i], path[i+1:]))
+}
+
+//serveLFSObject serves an object, objects that were pushed to another
+//member and haven't been replicated yet are fetched first
+func (ac *gitServer) serveLFSObject(w http.ResponseWriter, r *http.Request, repo, oid string) {
+	if !ac.lfs.Has(repo, oid) {
+		err := ac.fetchObject(&LFSObject{Repo: repo, Oid: oid, Size: -1})
+		if err != nil {
+			log.Printf("Failed to fetch lfs object '%s' of '%s': %s", oid, repo, err)
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, ac.lfs.Path(repo, oid))
+}
+
+//publishObject gossips a new object, large objects are seeded through
+//the exchange while small ones are fetched over http by members
+func (ac *gitServer) publishObject(o *LFSObject) error {
+	if o.Size >= ac.threshold && !ac.objects {
+		var err error
+		o.Link, err = ac.exchange.CreateLink(o.Oid, ac.lfs.Path(o.Repo, o.Oid))
+		if err != nil {
+			return err
+		}
+
+		err = ac.exchange.SeedLink(o.Link, ac.lfs.Dir(o.Repo))
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Gossip new lfs object '%s' of '%s' (link: '%s')...", o.Oid, o.Repo, o.Link)
+	return ac.gossip.EmitObject(o)
+}
+
+//PullObject replicates an object that was pushed to another member
+func (ac *gitServer) PullObject(o *LFSObject) error {
+	if !validRepoName(o.Repo) {
+		return fmt.Errorf("Invalid repository name '%s' in lfs object", o.Repo)
+	}
+
+	if !validOid(o.Oid) {
+		return fmt.Errorf("Invalid lfs object oid '%s'", o.Oid)
+	}
+
+	if ac.lfs.Has(o.Repo, o.Oid) {
+		return ac.journal.Done(objectKey(o))
+	}
+
+	err := ac.journal.Add(objectKey(o), &JournalEntry{Object: o})
+	if err != nil {
+		return err
+	}
+
+	if o.Link == "" {
+		go func() {
+			err := ac.fetchObject(o)
+			if err != nil {
+				log.Printf("Failed to fetch lfs object '%s' of '%s' over http: %s", o.Oid, o.Repo, err)
+				return
+			}
+
+			ac.importedObject(o)
+		}()
+
+		return nil
+	}
+
+	//the same content in another repository has the same link, when
+	//it was transferred already it is imported from there
+	for _, t := range ac.exchange.Transfers() {
+		if t.Link == o.Link && t.Done {
+			ac.completeObjects(t, []*LFSObject{o})
+			return nil
+		}
+	}
+
+	ac.mu.Lock()
+	ac.pendingObjects[o.Link] = append(ac.pendingObjects[o.Link], o)
+	ac.mu.Unlock()
+
+	dir := ac.lfs.Incoming(o.Repo, o.Oid)
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+
+	return ac.exchange.Pull(o.Link, dir)
+}
+
+//completeObject imports objects when their transfer is done
+func (ac *gitServer) completeObject(t Transfer) {
+	ac.mu.Lock()
+	objects, ok := ac.pendingObjects[t.Link]
+	delete(ac.pendingObjects, t.Link)
+	ac.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ac.completeObjects(t, objects)
+}
+
+//completeObjects imports the objects of all repositories that pulled
+//the same link, the transfer only downloaded it into one of them
+func (ac *gitServer) completeObjects(t Transfer, objects []*LFSObject) {
+	for _, o := range objects {
+		err := ac.lfs.Import(o, filepath.Join(t.Dir, o.Oid))
+		if err != nil {
+			log.Printf("Failed to import lfs object '%s' of '%s': %s", o.Oid, o.Repo, err)
+			continue
+		}
+
+		ac.importedObject(o)
+	}
+}
+
+//importedObject is called when a pulled object made it into the store
+func (ac *gitServer) importedObject(o *LFSObject) {
+	err := ac.journal.Done(objectKey(o))
+	if err != nil {
+		log.Printf("Failed to record import of lfs object '%s' of '%s' in the journal: %s", o.Oid, o.Repo, err)
+	}
+}
+
+//fetchObject downloads an object from the nearest member that has it
+func (ac *gitServer) fetchObject(o *LFSObject) error {
+	if !ac.bandwidth.waitOpen(ac.stop) {
+		return fmt.Errorf("Storage stopped")
+	}
+
+	members, err := ac.nearest()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range members {
+		err = ac.fetchObjectFrom(o, fmt.Sprintf("http://%s%s", net.JoinHostPort(m.IP().String(), strconv.Itoa(ac.port)), objectPath(o.Repo, o.Oid)))
+		if err != nil {
+			log.Printf("Member '%s' couldn't provide lfs object '%s' of '%s': %s", m.Name, o.Oid, o.Repo, err)
+			continue
+		}
+
+		log.Printf("Fetched lfs object '%s' of '%s' from member '%s'", o.Oid, o.Repo, m.Name)
+		return nil
+	}
+
+	return fmt.Errorf("None of the %d members provided lfs object '%s' of '%s'", len(members), o.Oid, o.Repo)
+}
+
+func (ac *gitServer) fetchObjectFrom(o *LFSObject, loc string) error {
+	resp, err := ac.client.Get(loc)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+
+	return ac.lfs.Write(o, resp.Body)
+}
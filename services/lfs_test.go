@@ -0,0 +1,69 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLFSObjectsArePerRepository(t *testing.T) {
+	ac := testServer(t)
+	testUser(t, ac, "alice", false)
+	for _, repo := range []string{"a", "b"} {
+		err := ac.access.Grant(&Grant{User: "alice", Repo: repo, Access: AccessRead})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := []byte("large file")
+	sum := sha256.Sum256(data)
+	oid := hex.EncodeToString(sum[:])
+	err := ac.lfs.Write(&LFSObject{Repo: "a", Oid: oid, Size: int64(len(data))}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		repo  string
+		found bool
+	}{
+		{repo: "a", found: true},
+		{repo: "b"},
+	} {
+		body, _ := json.Marshal(&lfsBatchRequest{Operation: "download", Objects: []*LFSObject{{Oid: oid, Size: int64(len(data))}}})
+		r := httptest.NewRequest("POST", "/"+c.repo+".git/info/lfs/objects/batch", bytes.NewReader(body))
+		w := testRequest(ac, r, "alice")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected batch of '%s' to succeed, got: %d %s", c.repo, w.Code, w.Body)
+		}
+
+		res := &lfsBatchResponse{}
+		err := json.NewDecoder(w.Body).Decode(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bo := res.Objects[0]
+		if c.found && (bo.Error != nil || bo.Actions["download"] == nil) {
+			t.Errorf("expected a download action in '%s', got: %+v", c.repo, bo)
+		}
+
+		if c.found && (!bo.Authenticated || bo.Actions["download"].Header["Authorization"] != r.Header.Get("Authorization")) {
+			t.Errorf("expected the download action in '%s' to carry the credentials of the request, got: %+v", c.repo, bo.Actions["download"])
+		}
+
+		if !c.found && (bo.Error == nil || bo.Error.Code != http.StatusNotFound || bo.Actions != nil) {
+			t.Errorf("expected a not found error in '%s', got: %+v", c.repo, bo)
+		}
+
+		w = testRequest(ac, httptest.NewRequest("GET", "/"+c.repo+".git/info/lfs/objects/"+oid, nil), "alice")
+		if found := w.Code == http.StatusOK; found != c.found {
+			t.Errorf("expected object to be found in '%s': %t, got: %d", c.repo, c.found, w.Code)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+//TransferLimits restrict the bandwidth an exchange uses, rates are in
+//bytes per second and zero means unlimited. Without windows transfers
+//are allowed at any time of the day
+type TransferLimits struct {
+	Upload       int64
+	Download     int64
+	PeerUpload   int64
+	PeerDownload int64
+
+	Windows []TransferWindow
+}
+
+//TransferWindow is a daily period, in local time, during which data
+//is transferred. Windows that end before they start cross midnight
+type TransferWindow struct {
+	From time.Duration
+	To   time.Duration
+}
+
+//ParseTransferWindow parses a window such as '19:00-07:00'
+func ParseTransferWindow(s string) (TransferWindow, error) {
+	tw := TransferWindow{}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return tw, fmt.Errorf("Invalid transfer window '%s', expected 'hh:mm-hh:mm'", s)
+	}
+
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return tw, fmt.Errorf("Invalid transfer window '%s': %s", s, err)
+		}
+
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			tw.From = d
+		} else {
+			tw.To = d
+		}
+	}
+
+	return tw, nil
+}
+
+//ParseSize parses a number of bytes, or a rate in bytes per second,
+//with an optional k, M or G suffix, e.g. '512k' or '10M'
+func ParseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1024
+	case "M":
+		mult = 1024 * 1024
+	case "G":
+		mult = 1024 * 1024 * 1024
+	}
+
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size '%s'", s)
+	}
+
+	return n * mult, nil
+}
+
+func (tw TransferWindow) contains(d time.Duration) bool {
+	if tw.From <= tw.To {
+		return d >= tw.From && d < tw.To
+	}
+
+	return d >= tw.From || d < tw.To
+}
+
+//Open returns whether transfers are allowed at t
+func (l TransferLimits) Open(t time.Time) bool {
+	if len(l.Windows) == 0 {
+		return true
+	}
+
+	y, m, d := t.Date()
+	since := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	for _, tw := range l.Windows {
+		if tw.contains(since) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//waitOpen blocks until a window opens, it returns false when stopped
+func (l TransferLimits) waitOpen(stop <-chan struct{}) bool {
+	for !l.Open(time.Now()) {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(time.Minute):
+		}
+	}
+
+	return true
+}
+
+//newLimiter returns a token bucket for a rate, unlimited for zero. The
+//bucket holds a torrent piece even for lower rates, the torrent client
+//reserves whole requests of peers and panics when they don't fit
+func newLimiter(bps int64) *rate.Limiter {
+	if bps <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+
+	return rate.NewLimiter(rate.Limit(bps), pieceLength)
+}
+
+//NewBandwidth returns the limiters for the limits of a node, all
+//transfers of the node must share them for the rates to hold
+func NewBandwidth(limits TransferLimits) *Bandwidth {
+	return &Bandwidth{
+		TransferLimits: limits,
+		upload:         newLimiter(limits.Upload),
+		download:       newLimiter(limits.Download),
+		peers:          map[string]*rate.Limiter{},
+	}
+}
+
+//Bandwidth is what the exchanges and the git server take tokens from
+//for every byte they send or receive, per peer limiters are keyed by
+//the host of the peer such that they cover all its connections
+type Bandwidth struct {
+	TransferLimits
+	upload   *rate.Limiter
+	download *rate.Limiter
+
+	mu    sync.Mutex
+	peers map[string]*rate.Limiter
+}
+
+//peer returns the limiter for one direction of a single peer
+func (b *Bandwidth) peer(dir, host string, bps int64) *rate.Limiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", dir, host)
+	l, ok := b.peers[key]
+	if !ok {
+		l = newLimiter(bps)
+		b.peers[key] = l
+	}
+
+	return l
+}
+
+//uploadTo returns the limiters for data sent to a host
+func (b *Bandwidth) uploadTo(host string) []*rate.Limiter {
+	return []*rate.Limiter{b.upload, b.peer("up", host, b.PeerUpload)}
+}
+
+//downloadFrom returns the limiters for data received from a host
+func (b *Bandwidth) downloadFrom(host string) []*rate.Limiter {
+	return []*rate.Limiter{b.download, b.peer("down", host, b.PeerDownload)}
+}
+
+//limitedReader takes tokens from all limiters for every read, a
+//transfer is both limited by the node wide and the per peer rate
+type limitedReader struct {
+	r        io.Reader
+	limiters []*rate.Limiter
+}
+
+func (lr *limitedReader) Read(b []byte) (int, error) {
+	for _, l := range lr.limiters {
+		if l.Burst() > 0 && len(b) > l.Burst() {
+			b = b[:l.Burst()]
+		}
+	}
+
+	n, err := lr.r.Read(b)
+	for _, l := range lr.limiters {
+		if n > 0 && l.Burst() > 0 {
+			l.WaitN(context.Background(), n)
+		}
+	}
+
+	return n, err
+}
+
+//limitedWriter is the writing counterpart of the limited reader
+type limitedWriter struct {
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+func (lw *limitedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		for _, l := range lw.limiters {
+			if l.Burst() > 0 && len(chunk) > l.Burst() {
+				chunk = chunk[:l.Burst()]
+			}
+		}
+
+		for _, l := range lw.limiters {
+			if l.Burst() > 0 {
+				l.WaitN(context.Background(), len(chunk))
+			}
+		}
+
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+//limitedBody limits the body of a request or response
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+//limitedResponse limits what a handler writes to a client
+type limitedResponse struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (lr *limitedResponse) Write(b []byte) (int, error) {
+	return lr.w.Write(b)
+}
+
+//limitedTransport limits the requests and responses of a client by
+//the host they are exchanged with
+type limitedTransport struct {
+	bw *Bandwidth
+}
+
+func (lt *limitedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.URL.Hostname()
+	if r.Body != nil {
+		r = r.Clone(r.Context())
+		r.Body = &limitedBody{Reader: &limitedReader{r: r.Body, limiters: lt.bw.uploadTo(host)}, Closer: r.Body}
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = &limitedBody{Reader: &limitedReader{r: resp.Body, limiters: lt.bw.downloadFrom(host)}, Closer: resp.Body}
+	return resp, nil
+}
+
+//limitedConn limits a peer connection of the torrent client by the
+//rates of the peer, the client applies the node wide rates itself
+type limitedConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func newLimitedConn(c net.Conn, bw *Bandwidth) net.Conn {
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	return &limitedConn{
+		Conn: c,
+		r:    &limitedReader{r: c, limiters: []*rate.Limiter{bw.peer("down", host, bw.PeerDownload)}},
+		w:    &limitedWriter{w: c, limiters: []*rate.Limiter{bw.peer("up", host, bw.PeerUpload)}},
+	}
+}
+
+func (lc *limitedConn) Read(b []byte) (int, error) {
+	return lc.r.Read(b)
+}
+
+func (lc *limitedConn) Write(b []byte) (int, error) {
+	return lc.w.Write(b)
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		size int64
+		err  bool
+	}{
+		{s: "", size: 0},
+		{s: "100", size: 100},
+		{s: "512k", size: 512 * 1024},
+		{s: "512K", size: 512 * 1024},
+		{s: "10M", size: 10 * 1024 * 1024},
+		{s: "2g", size: 2 * 1024 * 1024 * 1024},
+		{s: "M", err: true},
+		{s: "-1", err: true},
+		{s: "1.5M", err: true},
+		{s: "10MB", err: true},
+	} {
+		size, err := ParseSize(c.s)
+		if c.err {
+			if err == nil {
+				t.Errorf("expected '%s' to be rejected, got %d", c.s, size)
+			}
+		} else if err != nil {
+			t.Errorf("failed to parse '%s': %s", c.s, err)
+		} else if size != c.size {
+			t.Errorf("expected '%s' to be %d bytes, got %d", c.s, c.size, size)
+		}
+	}
+}
+
+func TestParseTransferWindow(t *testing.T) {
+	for _, s := range []string{"", "19:00", "19:00-", "19:00-07:00-08:00", "25:00-07:00", "7pm-7am"} {
+		if _, err := ParseTransferWindow(s); err == nil {
+			t.Errorf("expected '%s' to be rejected", s)
+		}
+	}
+
+	tw, err := ParseTransferWindow(" 19:30 - 07:00 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tw.From != 19*time.Hour+30*time.Minute || tw.To != 7*time.Hour {
+		t.Errorf("unexpected window: %+v", tw)
+	}
+}
+
+func TestTransferLimitsOpen(t *testing.T) {
+	at := func(hh, mm int) time.Time {
+		return time.Date(2020, 3, 14, hh, mm, 0, 0, time.Local)
+	}
+
+	for _, c := range []struct {
+		name    string
+		windows []string
+		at      time.Time
+		open    bool
+	}{
+		{name: "no windows", at: at(12, 0), open: true},
+		{name: "inside a day window", windows: []string{"09:00-17:00"}, at: at(12, 0), open: true},
+		{name: "start is inclusive", windows: []string{"09:00-17:00"}, at: at(9, 0), open: true},
+		{name: "end is exclusive", windows: []string{"09:00-17:00"}, at: at(17, 0)},
+		{name: "outside a day window", windows: []string{"09:00-17:00"}, at: at(8, 59)},
+		{name: "before midnight in a night window", windows: []string{"19:00-07:00"}, at: at(23, 30), open: true},
+		{name: "at midnight in a night window", windows: []string{"19:00-07:00"}, at: at(0, 0), open: true},
+		{name: "after midnight in a night window", windows: []string{"19:00-07:00"}, at: at(6, 59), open: true},
+		{name: "end of a night window", windows: []string{"19:00-07:00"}, at: at(7, 0)},
+		{name: "day outside a night window", windows: []string{"19:00-07:00"}, at: at(12, 0)},
+		{name: "any of several windows", windows: []string{"01:00-02:00", "12:00-13:00"}, at: at(12, 30), open: true},
+		{name: "none of several windows", windows: []string{"01:00-02:00", "12:00-13:00"}, at: at(3, 0)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			limits := TransferLimits{}
+			for _, w := range c.windows {
+				tw, err := ParseTransferWindow(w)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				limits.Windows = append(limits.Windows, tw)
+			}
+
+			if open := limits.Open(c.at); open != c.open {
+				t.Errorf("expected open: %t at %s, got %t", c.open, c.at.Format("15:04"), open)
+			}
+		})
+	}
+}
+
+func TestLimiterFitsPeerRequests(t *testing.T) {
+	for _, bps := range []int64{1, 1024, 16 * 1024, 10 * 1024 * 1024} {
+		if res := newLimiter(bps).ReserveN(time.Now(), pieceLength); !res.OK() {
+			t.Errorf("expected a limiter of %d bytes per second to fit a request of a whole piece", bps)
+		}
+	}
+}
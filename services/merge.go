@@ -0,0 +1,453 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//strategy that is used for repositories that weren't configured,
+//it merges like git does
+const DefaultMergeStrategy = "git"
+
+//strategy that resolves the conflicts of strategies that fail, such
+//that members still converge on the same commit
+const FallbackMergeStrategy = "keep-both"
+
+//notes that record the member a commit was pushed to, they are
+//replicated with the branches
+const originNotes = "refs/notes/cell"
+
+//identity of the commits that members create
+const (
+	mergeName  = "cellstate"
+	mergeEmail = "cell@cellstate"
+)
+
+//MergeSide is one of the two commits that are merged, with when it
+//was committed and the member it was pushed to. Which member merges
+//it isn't part of it as members must come to the same result
+type MergeSide struct {
+	Commit string    `json:"commit"`
+	Time   time.Time `json:"time"`
+	Node   string    `json:"node,omitempty"`
+}
+
+//After returns whether a side was written after another, by commit
+//time, then by the member it was pushed to and then by commit id
+//such that every member agrees on the order
+func (ms *MergeSide) After(other *MergeSide) bool {
+	if !ms.Time.Equal(other.Time) {
+		return ms.Time.After(other.Time)
+	}
+
+	if ms.Node != other.Node {
+		return ms.Node > other.Node
+	}
+
+	return ms.Commit > other.Commit
+}
+
+//Short returns the abbreviated commit id of a side
+func (ms *MergeSide) Short() string {
+	if len(ms.Commit) > 7 {
+		return ms.Commit[:7]
+	}
+
+	return ms.Commit
+}
+
+//Merge is a branch that diverged on two members, the sides are
+//ordered by when they were written and not by which member merges
+//them, such that all members come to the same result on their own
+type Merge struct {
+	Repo   string     `json:"repo"`
+	Branch string     `json:"branch"`
+	First  *MergeSide `json:"first"`
+	Second *MergeSide `json:"second"`
+}
+
+//MergeStrategy returns the tree of the merge of both sides, it may only
+//depend on the merge and the repository's objects such that every
+//member that merges the same sides creates the same commit
+type MergeStrategy func(repopath string, m *Merge) (tree string, err error)
+
+var strategiesMu sync.RWMutex
+var strategies = map[string]MergeStrategy{
+	"git":       mergeGit,
+	"lww":       mergeLastWriter,
+	"ours":      resolveWith(keepFirst),
+	"theirs":    resolveWith(keepSecond),
+	"keep-both": resolveWith(keepBoth),
+}
+
+//RegisterMergeStrategy makes a strategy available under a name, it
+//has to be registered on every member for repositories that use it
+func RegisterMergeStrategy(name string, strategy MergeStrategy) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strategies[name] = strategy
+}
+
+//RegisterMergeProgram makes an external program available as a
+//strategy, e.g. 'csv=/usr/local/bin/merge-csv --header'. Programs
+//are only ever registered locally, repositories refer to them by name
+func RegisterMergeProgram(program string) error {
+	parts := strings.SplitN(program, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || len(strings.Fields(parts[1])) == 0 {
+		return fmt.Errorf("Invalid merge program '%s', expected '<name>=<command>'", program)
+	}
+
+	RegisterMergeStrategy(parts[0], mergeExec(strings.Fields(parts[1])))
+	return nil
+}
+
+//MergeStrategies returns the names of all registered strategies
+func MergeStrategies() []string {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+	names := []string{}
+	for name := range strategies {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+//mergeStrategy returns the strategy that is registered by name
+func mergeStrategy(name string) (MergeStrategy, error) {
+	strategiesMu.RLock()
+	strategy, ok := strategies[name]
+	strategiesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown merge strategy '%s', use one of '%s'", name, strings.Join(MergeStrategies(), "', '"))
+	}
+
+	return strategy, nil
+}
+
+//mergeGit merges like git does, conflicting changes fail the merge
+//and are resolved by the fallback strategy
+func mergeGit(repopath string, m *Merge) (string, error) {
+	tree, conflicts, err := mergeTree(repopath, m.First.Commit, m.Second.Commit)
+	if err != nil {
+		return "", err
+	}
+
+	if len(conflicts) > 0 {
+		paths := []string{}
+		for _, c := range conflicts {
+			paths = append(paths, c.Path)
+		}
+
+		return "", fmt.Errorf("Branches have conflicting changes in '%s'", strings.Join(paths, "', '"))
+	}
+
+	return tree, nil
+}
+
+//mergeLastWriter keeps the tree of the side that was written last,
+//changes of the other side are only kept in the history
+func mergeLastWriter(repopath string, m *Merge) (string, error) {
+	return git(repopath, "rev-parse", "--verify", fmt.Sprintf("%s^{tree}", m.Second.Commit))
+}
+
+//treeEntry is a file in a tree, an entry without mode removes it
+type treeEntry struct {
+	Path   string
+	Mode   string
+	Object string
+}
+
+//mergeConflict is a path that both sides changed in ways that conflict,
+//with what is at the path in the base and on each side, nil where
+//the path doesn't exist
+type mergeConflict struct {
+	Path   string
+	Base   *treeEntry
+	First  *treeEntry
+	Second *treeEntry
+}
+
+//resolveWith merges like git does and resolves every conflicting path
+//with resolve, which returns the entries to put in the tree instead
+func resolveWith(resolve func(m *Merge, c *mergeConflict) []*treeEntry) MergeStrategy {
+	return func(repopath string, m *Merge) (string, error) {
+		tree, conflicts, err := mergeTree(repopath, m.First.Commit, m.Second.Commit)
+		if err != nil || len(conflicts) == 0 {
+			return tree, err
+		}
+
+		entries := []*treeEntry{}
+		for _, c := range conflicts {
+			entries = append(entries, resolve(m, c)...)
+		}
+
+		return writeTree(repopath, tree, entries)
+	}
+}
+
+//keepFirst resolves a conflict with the version that was written first,
+//it is 'ours' as the branch had it before the other side diverged
+func keepFirst(m *Merge, c *mergeConflict) []*treeEntry {
+	return []*treeEntry{keepEntry(c.Path, c.First)}
+}
+
+//keepSecond resolves a conflict with the version that was written last,
+//it is 'theirs' as it came in after the other side
+func keepSecond(m *Merge, c *mergeConflict) []*treeEntry {
+	return []*treeEntry{keepEntry(c.Path, c.Second)}
+}
+
+//keepBoth keeps the version that was written last at the path and
+//the other one as a conflict copy next to it, e.g. 'data.sync-conflict
+//-20160102-150405-5f3a9c1.csv', as Syncthing does
+func keepBoth(m *Merge, c *mergeConflict) []*treeEntry {
+	entries := []*treeEntry{keepEntry(c.Path, c.Second)}
+	if c.First != nil {
+		entries = append(entries, &treeEntry{Path: conflictCopyPath(c.Path, m.First), Mode: c.First.Mode, Object: c.First.Object})
+	}
+
+	return entries
+}
+
+//keepEntry returns the entry that puts a side's version at a path,
+//or removes it when the side removed it
+func keepEntry(p string, side *treeEntry) *treeEntry {
+	if side == nil {
+		return &treeEntry{Path: p}
+	}
+
+	return &treeEntry{Path: p, Mode: side.Mode, Object: side.Object}
+}
+
+//conflictCopyPath returns the path of the conflict copy of a file, it
+//is named after the time and commit of the side the copy is from
+func conflictCopyPath(p string, side *MergeSide) string {
+	ext := path.Ext(p)
+	if ext == path.Base(p) {
+		ext = ""
+	}
+
+	return fmt.Sprintf("%s.sync-conflict-%s-%s%s", strings.TrimSuffix(p, ext), side.Time.UTC().Format("20060102-150405"), side.Short(), ext)
+}
+
+//mergeExec runs a program to merge, it is called with the merge base
+//and both sides as arguments in the order they were written, runs
+//in the bare repository and prints the tree of the merge
+func mergeExec(args []string) MergeStrategy {
+	return func(repopath string, m *Merge) (string, error) {
+		base, err := git(repopath, "merge-base", m.First.Commit, m.Second.Commit)
+		if err != nil {
+			return "", err
+		}
+
+		argv := append(append([]string{}, args[1:]...), base, m.First.Commit, m.Second.Commit)
+		cmd := exec.Command(args[0], argv...)
+		cmd.Dir = repopath
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("GIT_DIR=%s", repopath),
+			fmt.Sprintf("CELL_REPO=%s", m.Repo),
+			fmt.Sprintf("CELL_BRANCH=%s", m.Branch),
+		)
+
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("Merge program '%s' failed: %s", args[0], err)
+		}
+
+		return git(repopath, "rev-parse", "--verify", fmt.Sprintf("%s^{tree}", strings.TrimSpace(string(out))))
+	}
+}
+
+//mergeTree merges two commits without a working tree, it returns the
+//tree of the merge, in which conflicting files have conflict markers,
+//and the paths that conflict
+func mergeTree(repopath, first, second string) (string, []*mergeConflict, error) {
+	cmd := exec.Command("git", "merge-tree", "--write-tree", "--no-messages", "-z", first, second)
+	cmd.Dir = repopath
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		err = nil //the merge has conflicts
+	}
+
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to merge '%s' and '%s' in '%s': %s", first, second, repopath, err)
+	}
+
+	//the tree is followed by '<mode> <object> <stage>\t<path>' for
+	//every side of a conflicting path, all terminated by NUL
+	fields := strings.Split(string(out), "\x00")
+	conflicts := []*mergeConflict{}
+	byPath := map[string]*mergeConflict{}
+	for _, f := range fields[1:] {
+		if f == "" {
+			break
+		}
+
+		parts := strings.SplitN(f, "\t", 2)
+		info := strings.Fields(parts[0])
+		if len(parts) != 2 || len(info) != 3 {
+			return "", nil, fmt.Errorf("Unexpected conflict '%s' merging '%s' and '%s'", f, first, second)
+		}
+
+		c, ok := byPath[parts[1]]
+		if !ok {
+			c = &mergeConflict{Path: parts[1]}
+			byPath[c.Path] = c
+			conflicts = append(conflicts, c)
+		}
+
+		entry := &treeEntry{Path: c.Path, Mode: info[0], Object: info[1]}
+		switch info[2] {
+		case "1":
+			c.Base = entry
+		case "2":
+			c.First = entry
+		case "3":
+			c.Second = entry
+		}
+	}
+
+	return fields[0], conflicts, nil
+}
+
+//writeTree writes a tree that is a copy of another with entries put
+//in place, using an index of its own
+func writeTree(repopath, tree string, entries []*treeEntry) (string, error) {
+	dir, err := ioutil.TempDir(repopath, "merge-")
+	if err != nil {
+		return "", err
+	}
+
+	defer os.RemoveAll(dir)
+	env := []string{fmt.Sprintf("GIT_INDEX_FILE=%s", filepath.Join(dir, "index"))}
+	_, err = gitEnv(repopath, env, "read-tree", tree)
+	if err != nil {
+		return "", err
+	}
+
+	info := &strings.Builder{}
+	for _, e := range entries {
+		if e.Mode == "" {
+			fmt.Fprintf(info, "0 %s\t%s\x00", zeroID, e.Path)
+			continue
+		}
+
+		fmt.Fprintf(info, "%s %s\t%s\x00", e.Mode, e.Object, e.Path)
+	}
+
+	cmd := exec.Command("git", "update-index", "-z", "--index-info")
+	cmd.Dir = repopath
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(info.String())
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("Failed to update index of merge in '%s': %s", repopath, err)
+	}
+
+	return gitEnv(repopath, env, "write-tree")
+}
+
+//mergeSide returns a commit as a side of a merge, when it was pushed
+//to several members at once the first of them is used
+func mergeSide(repopath, commit string) (*MergeSide, error) {
+	out, err := git(repopath, "show", "-s", "--format=%ct", commit)
+	if err != nil {
+		return nil, err
+	}
+
+	sec, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected commit time '%s' of '%s': %s", out, commit, err)
+	}
+
+	side := &MergeSide{Commit: commit, Time: time.Unix(sec, 0).UTC()}
+	if nodes := pushedTo(repopath, commit); len(nodes) > 0 {
+		sort.Strings(nodes)
+		side.Node = nodes[0]
+	}
+
+	return side, nil
+}
+
+//mergeTips returns the commits that are merged into a branch, merges
+//that members created are replaced by the commits they merged such
+//that the result only depends on the commits and not on the order in
+//which members saw them. Commits that others contain are left out,
+//the rest is ordered by when they were written
+func mergeTips(repopath string, commits ...string) ([]*MergeSide, error) {
+	seen := map[string]bool{}
+	tips := []string{}
+	for len(commits) > 0 {
+		commit := commits[0]
+		commits = commits[1:]
+		if seen[commit] {
+			continue
+		}
+
+		seen[commit] = true
+		out, err := git(repopath, "show", "-s", "--format=%ce %P", commit)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := strings.Fields(out)
+		if len(fields) == 3 && fields[0] == mergeEmail {
+			commits = append(commits, fields[1:]...)
+			continue
+		}
+
+		tips = append(tips, commit)
+	}
+
+	sides := []*MergeSide{}
+	for _, commit := range tips {
+		contained := false
+		for _, other := range tips {
+			if other != commit && isAncestor(repopath, commit, other) {
+				contained = true
+				break
+			}
+		}
+
+		if contained {
+			continue
+		}
+
+		side, err := mergeSide(repopath, commit)
+		if err != nil {
+			return nil, err
+		}
+
+		sides = append(sides, side)
+	}
+
+	sort.Slice(sides, func(i, j int) bool { return sides[j].After(sides[i]) })
+	return sides, nil
+}
+
+//pushedTo returns the members a commit was pushed to as its note
+//records them, it is empty for commits that members created
+func pushedTo(repopath, commit string) []string {
+	cmd := exec.Command("git", "notes", "--ref", originNotes, "show", commit)
+	cmd.Dir = repopath
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+
+	return strings.Fields(string(out))
+}
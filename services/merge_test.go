@@ -0,0 +1,194 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testSides creates commits that change the same file at the same
+//time on top of a base, such that only the members they were pushed
+//to can order them. Every member gets a clone with all of them
+func testSides(t *testing.T, nodes ...string) (map[string]string, map[string]*gitServer) {
+	src := filepath.Join(testDir(t), "src")
+	base := testCommits(t, src, 1)[0]
+	side := func(branch, content string) string {
+		_, err := git(src, "checkout", "-q", "-B", branch, base)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"file0.txt", branch + ".txt"} {
+			err = ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = git(src, "add", "-A")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		date := "1500000000 +0000"
+		env := []string{"GIT_AUTHOR_DATE=" + date, "GIT_COMMITTER_DATE=" + date}
+		_, err = gitEnv(src, env, "-c", "user.name=test", "-c", "user.email=test@cellstate", "commit", "-q", "-m", branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		commit, err := git(src, "rev-parse", "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return commit
+	}
+
+	commits := map[string]string{}
+	for _, node := range nodes {
+		commits[node] = side(node, fmt.Sprintf("written on %s\n", node))
+	}
+
+	members := map[string]*gitServer{}
+	for _, node := range nodes {
+		ac := testServer(t)
+		ac.node = node
+		repopath := filepath.Join(ac.root, "test")
+		_, err := git(ac.root, "clone", "-q", "--bare", src, repopath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//as if every commit was pushed to the member of its name
+		for _, writer := range nodes {
+			ac.node = writer
+			ac.notePushed(repopath, []string{commits[writer]})
+		}
+
+		ac.node = node
+		members[node] = ac
+	}
+
+	return commits, members
+}
+
+func TestMergeConvergesOnAllMembers(t *testing.T) {
+	commits, members := testSides(t, "one", "two", "three")
+	one, two := commits["one"], commits["two"]
+
+	//the side with the larger commit id was pushed to the member that
+	//sorts first, such that only members order the sides
+	first, last := "one", "two"
+	if one < two {
+		first, last = "two", "one"
+	}
+
+	for _, ac := range members {
+		for node, writer := range map[string]string{"a": first, "b": last} {
+			_, err := gitEnv(filepath.Join(ac.root, "test"), memberEnv(time.Now()), "notes", "--ref", originNotes, "add", "-f", "-m", node, commits[writer])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, strategy := range MergeStrategies() {
+		results := map[string]string{}
+		for node, in := range map[string]*Integration{
+			"one":   {Repo: "test", Branch: "master", Origin: "two", Local: one, Remote: two},
+			"two":   {Repo: "test", Branch: "master", Origin: "one", Local: two, Remote: one},
+			"three": {Repo: "test", Branch: "master", Origin: "one", Local: two, Remote: one},
+		} {
+			ac := members[node]
+			_, err := ac.SetStrategy("test", strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			merged, err := ac.merge(filepath.Join(ac.root, "test"), in)
+			if err != nil {
+				merged = "failed"
+			}
+
+			results[node] = merged
+		}
+
+		if results["one"] != results["two"] || results["one"] != results["three"] {
+			t.Errorf("expected strategy '%s' to create the same merge on all members, got: %v", strategy, results)
+		}
+
+		if results["one"] == "failed" {
+			t.Errorf("expected strategy '%s' to resolve the conflict", strategy)
+		}
+
+		//sides written at the same time are ordered by member, the
+		//last one is kept
+		tree, err := git(filepath.Join(members["one"].root, "test"), "rev-parse", results["one"]+":file0.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := git(filepath.Join(members["one"].root, "test"), "cat-file", "-p", tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "written on " + last
+		if strategy == "ours" {
+			expected = "written on " + first
+		}
+
+		if content != expected {
+			t.Errorf("expected strategy '%s' to keep '%s', got: '%s'", strategy, expected, content)
+		}
+	}
+}
+
+func TestMergeOfConcurrentWritersIgnoresOrder(t *testing.T) {
+	commits, members := testSides(t, "one", "two", "three")
+	merge := func(ac *gitServer, local, remote string) string {
+		merged, err := ac.merge(filepath.Join(ac.root, "test"), &Integration{Repo: "test", Branch: "master", Local: local, Remote: remote})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return merged
+	}
+
+	//every member saw the writes of the others in a different order
+	results := map[string]string{}
+	for node, order := range map[string][]string{
+		"one":   {"one", "two", "three"},
+		"two":   {"two", "three", "one"},
+		"three": {"three", "one", "two"},
+	} {
+		ac := members[node]
+		merged := merge(ac, commits[order[0]], commits[order[1]])
+		results[node] = merge(ac, merged, commits[order[2]])
+	}
+
+	//or merged the merges of members that saw two of them
+	ac := members["one"]
+	results["merges"] = merge(ac, merge(ac, commits["one"], commits["two"]), merge(ac, commits["two"], commits["three"]))
+	for node, merged := range results {
+		if merged != results["one"] {
+			t.Errorf("expected all members to converge, '%s' got: %v", node, results)
+		}
+	}
+}
+
+func TestStrategiesAreRegisteredLocally(t *testing.T) {
+	ac := testServer(t)
+	_, err := ac.SetStrategy("test", "exec:/bin/true")
+	if err == nil {
+		t.Errorf("expected programs to only be usable when registered")
+	}
+
+	err = RegisterMergeProgram("no-command=")
+	if err == nil {
+		t.Errorf("expected a program without command to be refused")
+	}
+}
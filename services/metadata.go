@@ -0,0 +1,144 @@
+package services
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func NewMetadataStore(dir string, bind string, auth *ClusterAuth) (*metadataStore, error) {
+	return &metadataStore{
+		dir:  dir,
+		bind: bind,
+		auth: auth,
+	}, nil
+}
+
+//metadata store keeps the torrent metadata of links we created or
+//pulled and serves it to members only, by info hash. Members that
+//pull a link get the metadata from it instead of waiting for peers
+type metadataStore struct {
+	dir      string
+	bind     string
+	auth     *ClusterAuth
+	listener net.Listener
+}
+
+func (ms *metadataStore) Start() error {
+	err := os.MkdirAll(ms.dir, 0777)
+	if err != nil {
+		return err
+	}
+
+	ms.listener, err = net.Listen("tcp", ms.bind)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Printf("Metadata store listening on '%s'...", ms.bind)
+		err := http.Serve(ms.listener, ms.auth.Require(ms))
+		if err != nil && !strings.Contains(err.Error(), "closed network connection") {
+			log.Printf("Metadata store failed: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func (ms *metadataStore) Stop() error {
+	return ms.listener.Close()
+}
+
+func (ms *metadataStore) path(ih metainfo.Hash) string {
+	return filepath.Join(ms.dir, fmt.Sprintf("%s.torrent", ih.HexString()))
+}
+
+//Register stores metadata such that it can be served
+func (ms *metadataStore) Register(mi *metainfo.MetaInfo) error {
+	buf := bytes.NewBuffer(nil)
+	err := mi.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	path := ms.path(mi.HashInfoBytes())
+	tmp := fmt.Sprintf("%s.tmp", path)
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0666)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+//Get returns registered metadata, or nil when it isn't known
+func (ms *metadataStore) Get(ih metainfo.Hash) *metainfo.MetaInfo {
+	mi, err := metainfo.LoadFromFile(ms.path(ih))
+	if err != nil {
+		return nil
+	}
+
+	return mi
+}
+
+func (ms *metadataStore) Remove(ih metainfo.Hash) error {
+	err := os.Remove(ms.path(ih))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+//ServeHTTP serves the metadata registered under the info hash in the path
+func (ms *metadataStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(r.URL.Path, "/")
+	if _, err := hex.DecodeString(name); err != nil || len(name) != 40 || r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	ih := metainfo.NewHashFromHex(name)
+	if _, err := os.Stat(ms.path(ih)); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	http.ServeFile(w, r, ms.path(ih))
+}
+
+//Fetch gets the metadata of an info hash from the store of a member,
+//the info is hashed so a member can't hand out other metadata
+func (ms *metadataStore) Fetch(base string, ih metainfo.Hash) (*metainfo.MetaInfo, error) {
+	resp, err := ms.auth.Get(fmt.Sprintf("%s/%s", base, ih.HexString()))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+
+	mi, err := metainfo.Load(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if mi.HashInfoBytes() != ih {
+		return nil, fmt.Errorf("Metadata from '%s' doesn't match info hash '%s'", base, ih.HexString())
+	}
+
+	return mi, ms.Register(mi)
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+//SetUpdate is gossiped when a replicated set changed on a member,
+//it is small enough for an event, members fetch the set from it
+type SetUpdate struct {
+	Set  string `json:"set"`
+	From string `json:"from"`
+}
+
+//setEntry is a single value of a replicated set, removed entries
+//are kept as tombstones such that a removal replicates as well
+type setEntry struct {
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Updated time.Time       `json:"updated"`
+}
+
+//newer returns whether e wins over o, the most recent update wins
+//and ties are broken by content such that all members agree
+func (e *setEntry) newer(o *setEntry) bool {
+	if !e.Updated.Equal(o.Updated) {
+		return e.Updated.After(o.Updated)
+	}
+
+	if e.Deleted != o.Deleted {
+		return e.Deleted
+	}
+
+	return bytes.Compare(e.Value, o.Value) > 0
+}
+
+func NewReplicatedSet(name, path string, auth *ClusterAuth) (*replicatedSet, error) {
+	rs := &replicatedSet{
+		name:    name,
+		path:    path,
+		auth:    auth,
+		entries: map[string]*setEntry{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rs, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &rs.entries)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read replicated set '%s': %s", path, err)
+	}
+
+	return rs, nil
+}
+
+//replicated set is a small map of json values that every member
+//keeps a full copy of. Changes are gossiped and members fetch and
+//merge the complete set, the last update of an entry wins
+type replicatedSet struct {
+	name string
+	path string
+	auth *ClusterAuth
+
+	mu      sync.Mutex
+	entries map[string]*setEntry
+}
+
+//Put stores a value under an id, it replaces what was stored before
+func (rs *replicatedSet) Put(id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.entries[id] = &setEntry{Value: data, Updated: time.Now()}
+	return rs.write()
+}
+
+//Delete removes the value stored under an id, it returns false
+//when there was no such value
+func (rs *replicatedSet) Delete(id string) (bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	e, ok := rs.entries[id]
+	if !ok || e.Deleted {
+		return false, nil
+	}
+
+	rs.entries[id] = &setEntry{Deleted: true, Updated: time.Now()}
+	return true, rs.write()
+}
+
+//Get decodes the value stored under an id into v, it returns
+//false when there is no such value
+func (rs *replicatedSet) Get(id string, v interface{}) bool {
+	rs.mu.Lock()
+	e, ok := rs.entries[id]
+	rs.mu.Unlock()
+	if !ok || e.Deleted {
+		return false
+	}
+
+	err := json.Unmarshal(e.Value, v)
+	if err != nil {
+		log.Printf("Failed to decode '%s' in replicated set '%s': %s", id, rs.name, err)
+		return false
+	}
+
+	return true
+}
+
+//IDs returns the sorted ids of all values in the set
+func (rs *replicatedSet) IDs() []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	ids := []string{}
+	for id, e := range rs.entries {
+		if !e.Deleted {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+//Merge adds the entries of another member that are newer than ours,
+//it returns whether anything changed
+func (rs *replicatedSet) Merge(entries map[string]*setEntry) (bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	changed := false
+	for id, e := range entries {
+		if cur, ok := rs.entries[id]; ok && !e.newer(cur) {
+			continue
+		}
+
+		rs.entries[id] = e
+		changed = true
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	return true, rs.write()
+}
+
+//ServeHTTP serves all entries, including tombstones
+func (rs *replicatedSet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.mu.Lock()
+	data, err := json.Marshal(rs.entries)
+	rs.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+//Fetch merges the set as it is served by a member at loc
+func (rs *replicatedSet) Fetch(loc string) (bool, error) {
+	resp, err := rs.auth.Get(loc)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+
+	entries := map[string]*setEntry{}
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return false, err
+	}
+
+	return rs.Merge(entries)
+}
+
+//write replaces the set on disk, the caller holds the lock
+func (rs *replicatedSet) write() error {
+	data, err := json.Marshal(rs.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.tmp", rs.path)
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, rs.path)
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplicatedSetMerge(t *testing.T) {
+	now := time.Now()
+	value := func(v string, updated time.Time) *setEntry {
+		data, _ := json.Marshal(v)
+		return &setEntry{Value: data, Updated: updated}
+	}
+
+	tombstone := func(updated time.Time) *setEntry {
+		return &setEntry{Deleted: true, Updated: updated}
+	}
+
+	for _, c := range []struct {
+		name    string
+		ours    *setEntry
+		theirs  *setEntry
+		value   string
+		deleted bool
+	}{
+		{name: "new entry is added", theirs: value("b", now), value: "b"},
+		{name: "newer update wins", ours: value("a", now), theirs: value("b", now.Add(time.Second)), value: "b"},
+		{name: "older update loses", ours: value("a", now), theirs: value("b", now.Add(-time.Second)), value: "a"},
+		{name: "newer tombstone removes", ours: value("a", now), theirs: tombstone(now.Add(time.Second)), deleted: true},
+		{name: "older tombstone loses", ours: value("a", now), theirs: tombstone(now.Add(-time.Second)), value: "a"},
+		{name: "update after tombstone restores", ours: tombstone(now), theirs: value("b", now.Add(time.Second)), value: "b"},
+		{name: "tombstone wins a tie", ours: value("a", now), theirs: tombstone(now), deleted: true},
+		{name: "larger value wins a tie", ours: value("b", now), theirs: value("a", now), value: "b"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			//merging in either order must end with the same entry
+			for _, order := range [][]*setEntry{{c.ours, c.theirs}, {c.theirs, c.ours}} {
+				rs, err := NewReplicatedSet("test", filepath.Join(testDir(t), "test.json"), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, e := range order {
+					if e == nil {
+						continue
+					}
+
+					_, err = rs.Merge(map[string]*setEntry{"id": e})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				v := ""
+				if ok := rs.Get("id", &v); ok == c.deleted {
+					t.Fatalf("expected deleted: %t, got %t", c.deleted, !ok)
+				}
+
+				if v != c.value {
+					t.Errorf("expected value '%s', got '%s'", c.value, v)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicatedSetMergeChanged(t *testing.T) {
+	rs, err := NewReplicatedSet("test", filepath.Join(testDir(t), "test.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rs.Put("id", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs.mu.Lock()
+	entries := map[string]*setEntry{"id": rs.entries["id"]}
+	rs.mu.Unlock()
+	changed, err := rs.Merge(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed {
+		t.Errorf("expected merging the same entries not to change the set")
+	}
+
+	//the merged set is written such that it survives a restart
+	reopened, err := NewReplicatedSet("test", rs.path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := ""
+	if !reopened.Get("id", &v) || v != "a" {
+		t.Errorf("expected reopened set to have 'a', got '%s'", v)
+	}
+}
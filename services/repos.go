@@ -0,0 +1,203 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//a single segment of a repository name, namespaces and the name
+//itself all follow it
+var repoSegmentExp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+//repository names can't be nested deeper than this
+const maxRepoDepth = 8
+
+//first segments that would collide with other http endpoints
+var reservedRepoNames = map[string]bool{"seed": true, "chunks": true, "has": true, "sets": true, "lfs": true, "info": true}
+
+//RepoInfo is a repository that was created or configured explicitly,
+//such repositories are replicated to all members
+type RepoInfo struct {
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	Strategy string    `json:"strategy,omitempty"`
+}
+
+//validRepoName returns whether a name is a canonical repository name,
+//one or more namespaces followed by the name separated by slashes
+func validRepoName(name string) bool {
+	segments := strings.Split(name, "/")
+	if len(segments) > maxRepoDepth || reservedRepoNames[segments[0]] {
+		return false
+	}
+
+	for _, s := range segments {
+		if len(s) > 100 || !repoSegmentExp.MatchString(s) || strings.HasSuffix(s, ".git") || strings.HasSuffix(s, ".lock") {
+			return false
+		}
+	}
+
+	return true
+}
+
+//ParseRepoName returns the canonical name of the repository a client
+//refers to, e.g. '/team/dataset.git' is 'team/dataset'
+func ParseRepoName(path string) (string, error) {
+	name := strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if !validRepoName(name) {
+		return "", fmt.Errorf("Invalid repository name '%s', use letters, digits, '.', '_' and '-' in namespaces separated by '/'", strings.Trim(path, "/"))
+	}
+
+	return name, nil
+}
+
+//isRepo returns whether there is a bare repository at path
+func isRepo(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "HEAD"))
+	return err == nil
+}
+
+//repo returns the path of a repository a user asked for, it is created
+//when it doesn't exist yet and the user may create it
+func (ac *gitServer) repo(name, user string, write bool) (string, error) {
+	repopath := filepath.Join(ac.root, name)
+	exists := isRepo(repopath)
+	if !exists {
+		write = true
+	}
+
+	if !ac.access.Allowed(user, name, write) {
+		return "", ErrAccessDenied
+	}
+
+	if exists {
+		return repopath, nil
+	}
+
+	if !ac.create && !ac.declared.Get(name, &RepoInfo{}) {
+		return "", ErrRepoNotFound
+	}
+
+	return repopath, ac.initRepo(name)
+}
+
+//initRepo creates a repository, a repository can't be created inside
+//another or in place of a namespace that has repositories
+func (ac *gitServer) initRepo(name string) error {
+	if !validRepoName(name) {
+		return fmt.Errorf("Invalid repository name '%s'", name)
+	}
+
+	repopath := filepath.Join(ac.root, name)
+	if isRepo(repopath) {
+		return nil
+	}
+
+	for dir := filepath.Dir(repopath); dir != ac.root; dir = filepath.Dir(dir) {
+		if isRepo(dir) {
+			return fmt.Errorf("Can't create '%s' inside repository '%s'", name, strings.TrimPrefix(dir, ac.root+string(filepath.Separator)))
+		}
+	}
+
+	if fis, err := ioutil.ReadDir(repopath); err == nil && len(fis) > 0 {
+		return fmt.Errorf("Can't create '%s', it is a namespace of other repositories", name)
+	}
+
+	return initRepo(repopath)
+}
+
+//CreateRepo creates a repository on this member and lets all members
+//know it exists, when repositories aren't created on push this is
+//the only way to create them
+func (ac *gitServer) CreateRepo(name string) (*RepoInfo, error) {
+	name, err := ParseRepoName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ac.initRepo(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &RepoInfo{Name: name}
+	ac.declared.Get(name, info)
+	info.Created = time.Now()
+	err = ac.declared.Put(name, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, ac.gossipSet(ac.declared)
+}
+
+//SetStrategy configures how branches of a repository that diverged on
+//different members are merged, the configuration is replicated such
+//that all members merge the same way. Configuring a repository also
+//declares it, like creating it does
+func (ac *gitServer) SetStrategy(name, strategy string) (*RepoInfo, error) {
+	name, err := ParseRepoName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = mergeStrategy(strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &RepoInfo{Name: name}
+	ac.declared.Get(name, info)
+	info.Strategy = strategy
+	err = ac.declared.Put(name, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, ac.gossipSet(ac.declared)
+}
+
+//strategy returns the name of the merge strategy of a repository
+func (ac *gitServer) strategy(name string) string {
+	info := &RepoInfo{}
+	if !ac.declared.Get(name, info) || info.Strategy == "" {
+		return DefaultMergeStrategy
+	}
+
+	return info.Strategy
+}
+
+//Repos returns the repositories on this member and the ones that were
+//created explicitly on any member
+func (ac *gitServer) Repos() ([]*RepoInfo, error) {
+	names, err := ac.repos()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := map[string]*RepoInfo{}
+	for _, name := range names {
+		infos[name] = &RepoInfo{Name: name, Strategy: DefaultMergeStrategy}
+	}
+
+	for _, name := range ac.declared.IDs() {
+		info := &RepoInfo{Strategy: DefaultMergeStrategy}
+		if ac.declared.Get(name, info) {
+			infos[name] = info
+		}
+	}
+
+	res := []*RepoInfo{}
+	for _, info := range infos {
+		res = append(res, info)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
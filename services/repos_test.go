@@ -0,0 +1,50 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRepoName(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		name string
+		err  bool
+	}{
+		{path: "/test.git", name: "test"},
+		{path: "test", name: "test"},
+		{path: "/team/dataset.git", name: "team/dataset"},
+		{path: "/org/team/v1.2_data-set.git/", name: "org/team/v1.2_data-set"},
+		{path: "/a/b/c/d/e/f/g/h.git", name: "a/b/c/d/e/f/g/h"},
+		{path: "/", err: true},
+		{path: "/.git", err: true},
+		{path: "/a/b/c/d/e/f/g/h/i.git", err: true},
+		{path: "/team//dataset.git", err: true},
+		{path: "/team/../dataset.git", err: true},
+		{path: "/.hidden.git", err: true},
+		{path: "/-flag.git", err: true},
+		{path: "/team/data set.git", err: true},
+		{path: "/team/dataset.git.git", err: true},
+		{path: "/team/dataset.lock", err: true},
+		{path: "/team\\dataset.git", err: true},
+		{path: "/seed/dataset.git", err: true},
+		{path: "/lfs.git", err: true},
+		{path: "/team/seed.git", name: "team/seed"},
+		{path: "/" + strings.Repeat("a", 101) + ".git", err: true},
+	} {
+		name, err := ParseRepoName(c.path)
+		if c.err {
+			if err == nil {
+				t.Errorf("expected '%s' to be rejected, got '%s'", c.path, name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("failed to parse '%s': %s", c.path, err)
+		} else if name != c.name {
+			t.Errorf("expected '%s' to be named '%s', got '%s'", c.path, c.name, name)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+//the object id git uses for refs that don't exist
+const zeroID = "0000000000000000000000000000000000000000"
+
+//RefUpdate is a single ref that a push changed, old is the zero id
+//for refs that were created and new is the zero id for deletions
+type RefUpdate struct {
+	Ref string
+	Old string
+	New string
+}
+
+//ReceiveFunc is called after a push with the refs it changed, the
+//client waits for it to return
+type ReceiveFunc func(repo, repopath string, updates []RefUpdate)
+
+//smart http endpoints relative to a repository
+var smartPaths = []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"}
+
+//splitSmartPath splits a request path in the repository and the
+//smart http endpoint, ok is false when it isn't a smart http path
+func splitSmartPath(path string) (repo string, endpoint string, ok bool) {
+	for _, p := range smartPaths {
+		if strings.HasSuffix(path, p) {
+			return strings.TrimSuffix(path, p), p, true
+		}
+	}
+
+	return "", "", false
+}
+
+func NewSmartHTTP() (*smartHTTP, error) {
+	return &smartHTTP{}, nil
+}
+
+//smart http serves the git smart http protocol without cgi, requests
+//are framed and the ref updates of pushes are parsed in-process. The
+//negotiation and packs are left to upload-pack and receive-pack which
+//run once per request as stateless rpc, protocol v2 is passed on to
+//upload-pack. Receive funcs are called before the push is answered
+type smartHTTP struct {
+	receive []ReceiveFunc
+}
+
+//OnReceive registers a func that is called after every push
+func (sh *smartHTTP) OnReceive(fn ReceiveFunc) {
+	sh.receive = append(sh.receive, fn)
+}
+
+func writePktLine(w io.Writer, line string) error {
+	_, err := fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+	return err
+}
+
+func writeFlush(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+//readPktLine returns the payload of a single pkt-line, flush is true
+//for a flush packet which carries no payload
+func readPktLine(r io.Reader) (line []byte, flush bool, err error) {
+	head := make([]byte, 4)
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		return nil, false, err
+	}
+
+	n, err := strconv.ParseUint(string(head), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("Invalid pkt-line length '%s'", head)
+	}
+
+	if n == 0 {
+		return nil, true, nil
+	}
+
+	if n < 4 {
+		return nil, false, fmt.Errorf("Invalid pkt-line length %d", n)
+	}
+
+	line = make([]byte, n-4)
+	_, err = io.ReadFull(r, line)
+	return line, false, err
+}
+
+//Serve handles a smart http request for the repository at repopath
+func (sh *smartHTTP) Serve(w http.ResponseWriter, r *http.Request, repo, repopath, endpoint string) {
+	w.Header().Set("Cache-Control", "no-cache")
+	switch {
+	case endpoint == "/info/refs" && r.Method == "GET":
+		sh.serveRefs(w, r, repopath)
+	case endpoint == "/git-upload-pack" && r.Method == "POST":
+		sh.serveRPC(w, r, repopath, "upload-pack", nil)
+	case endpoint == "/git-receive-pack" && r.Method == "POST":
+		sh.serveReceive(w, r, repo, repopath)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//serveRefs advertises the refs of the repository for a service, with
+//protocol v2 git advertises its capabilities instead
+func (sh *smartHTTP) serveRefs(w http.ResponseWriter, r *http.Request, repopath string) {
+	service := r.URL.Query().Get("service")
+	if service != "git-upload-pack" && service != "git-receive-pack" {
+		http.Error(w, "Only the smart http protocol is supported", http.StatusForbidden)
+		return
+	}
+
+	cmd := exec.Command("git", strings.TrimPrefix(service, "git-"), "--stateless-rpc", "--advertise-refs", ".")
+	cmd.Dir = repopath
+	cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_PROTOCOL=%s", r.Header.Get("Git-Protocol")))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to advertise refs: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	if !strings.Contains(r.Header.Get("Git-Protocol"), "version=2") || service != "git-upload-pack" {
+		writePktLine(w, fmt.Sprintf("# service=%s\n", service))
+		writeFlush(w)
+	}
+
+	w.Write(out)
+}
+
+//serveRPC streams the request body through a git service, the body
+//may be prefixed with bytes that were already read from it
+func (sh *smartHTTP) serveRPC(w http.ResponseWriter, r *http.Request, repopath, service string, prefix []byte) error {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return err
+		}
+
+		defer gz.Close()
+		body = gz
+	}
+
+	cmd := exec.Command("git", service, "--stateless-rpc", ".")
+	cmd.Dir = repopath
+	cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_PROTOCOL=%s", r.Header.Get("Git-Protocol")))
+	cmd.Stdin = io.MultiReader(bytes.NewReader(prefix), body)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-result", service))
+	err := cmd.Run()
+	if err != nil {
+		log.Printf("Failed to run '%s' in '%s': %s", service, repopath, err)
+	}
+
+	return err
+}
+
+//serveReceive reads the ref update commands of a push before handing
+//it to receive-pack, the updates that were applied are reported
+func (sh *smartHTTP) serveReceive(w http.ResponseWriter, r *http.Request, repo, repopath string) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		defer gz.Close()
+		r.Body = gz
+		r.Header.Del("Content-Encoding")
+	}
+
+	//commands are pkt-lines of '<old> <new> <ref>' up to a flush, the
+	//first one carries the capabilities after a nul byte
+	prefix := bytes.NewBuffer(nil)
+	br := bufio.NewReader(r.Body)
+	updates := []RefUpdate{}
+	for {
+		line, flush, err := readPktLine(io.TeeReader(br, prefix))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read push commands: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if flush {
+			break
+		}
+
+		line = bytes.SplitN(line, []byte{0}, 2)[0]
+		fields := strings.Fields(string(line))
+		if len(fields) != 3 {
+			http.Error(w, fmt.Sprintf("Invalid push command '%s'", line), http.StatusBadRequest)
+			return
+		}
+
+		updates = append(updates, RefUpdate{Old: fields[0], New: fields[1], Ref: fields[2]})
+	}
+
+	r.Body = ioutil.NopCloser(br)
+	err := sh.serveRPC(w, r, repopath, "receive-pack", prefix.Bytes())
+	if err != nil {
+		return
+	}
+
+	//receive-pack may reject some of the updates, e.g. non fast-forwards
+	applied := []RefUpdate{}
+	for _, u := range updates {
+		current, _ := git(repopath, "rev-parse", "--verify", "-q", u.Ref)
+		if current == u.New || (u.New == zeroID && current == "") {
+			applied = append(applied, u)
+		}
+	}
+
+	if len(applied) == 0 {
+		return
+	}
+
+	for _, fn := range sh.receive {
+		fn(repo, repopath, applied)
+	}
+}
@@ -0,0 +1,363 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//Snapshot is an immutable git bundle of the branches and tags of a
+//repository, it is the unit of data that members exchange. It is
+//identified by a hash of the refs it holds such that any update to
+//them results in a new snapshot, Commit is what HEAD pointed to. When
+//an earlier snapshot is available an incremental bundle with only the
+//objects since that base is available as well. Origin is the member
+//the snapshot was pushed to
+type Snapshot struct {
+	Repo   string `json:"repo"`
+	Origin string `json:"origin"`
+	ID     string `json:"id"`
+	Commit string `json:"commit"`
+	Link   string `json:"link"`
+	Base   string `json:"base,omitempty"`
+	Delta  string `json:"delta,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+func (s *Snapshot) Filename() string {
+	return fmt.Sprintf("%s.bundle", s.ID)
+}
+
+func (s *Snapshot) DeltaFilename() string {
+	return fmt.Sprintf("%s..%s.bundle", s.Base, s.ID)
+}
+
+func (s *Snapshot) RefsFilename() string {
+	return fmt.Sprintf("%s.refs", s.ID)
+}
+
+//SnapshotRef is a branch or tag in a snapshot and what it points to
+type SnapshotRef struct {
+	Name   string
+	Object string
+}
+
+//snapshotListing returns the branches, tags and notes of a repository,
+//the listing is what identifies a snapshot
+func snapshotListing(repopath string) ([]byte, error) {
+	out, err := git(repopath, "for-each-ref", "--format=%(objectname) %(refname)", "refs/heads", "refs/tags", originNotes)
+	if err != nil {
+		return nil, err
+	}
+
+	if out == "" {
+		return nil, fmt.Errorf("Repository '%s' has no refs", repopath)
+	}
+
+	return []byte(out + "\n"), nil
+}
+
+//maxRefsSize limits the listing of refs members accept from each other
+const maxRefsSize = 16 * 1024 * 1024
+
+//snapshotID returns the hash of a listing of refs
+func snapshotID(listing []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(listing))
+}
+
+//ParseSnapshotRefs parses a listing of refs, it fails when the
+//listing doesn't hash to the id of the snapshot
+func ParseSnapshotRefs(id string, listing []byte) ([]SnapshotRef, error) {
+	if snapshotID(listing) != id {
+		return nil, fmt.Errorf("Refs don't match snapshot '%s'", id)
+	}
+
+	refs := []SnapshotRef{}
+	for _, line := range strings.Split(strings.TrimSpace(string(listing)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !validObjectName(fields[0]) || !strings.HasPrefix(fields[1], "refs/") {
+			return nil, fmt.Errorf("Invalid ref '%s' in snapshot '%s'", line, id)
+		}
+
+		refs = append(refs, SnapshotRef{Name: fields[1], Object: fields[0]})
+	}
+
+	return refs, nil
+}
+
+//hasRefs returns whether every ref tip is present in the repository
+func hasRefs(repopath string, refs []SnapshotRef) bool {
+	objects := []string{}
+	for _, ref := range refs {
+		objects = append(objects, ref.Object)
+	}
+
+	cmd := exec.Command("git", "cat-file", "--batch-check=%(objectname)")
+	cmd.Dir = repopath
+	cmd.Stdin = strings.NewReader(strings.Join(objects, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return false
+	}
+
+	return !bytes.Contains(out, []byte(" missing"))
+}
+
+func NewSnapshotStore(root string) (*snapshotStore, error) {
+	return &snapshotStore{
+		root:  root,
+		locks: map[string]*sync.Mutex{},
+	}, nil
+}
+
+//snapshot store keeps bundles per repository, a bundle
+//is never modified after it has been written
+type snapshotStore struct {
+	root string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+//lock serializes snapshot creation for a single repository
+func (ss *snapshotStore) lock(repo string) *sync.Mutex {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	l, ok := ss.locks[repo]
+	if !ok {
+		l = &sync.Mutex{}
+		ss.locks[repo] = l
+	}
+
+	return l
+}
+
+//Dir returns the directory that holds the snapshots of a repository
+func (ss *snapshotStore) Dir(repo string) string {
+	return filepath.Join(ss.root, repo)
+}
+
+func (ss *snapshotStore) Path(s *Snapshot) string {
+	return filepath.Join(ss.Dir(s.Repo), s.Filename())
+}
+
+func (ss *snapshotStore) DeltaPath(s *Snapshot) string {
+	return filepath.Join(ss.Dir(s.Repo), s.DeltaFilename())
+}
+
+func (ss *snapshotStore) RefsPath(s *Snapshot) string {
+	return filepath.Join(ss.Dir(s.Repo), s.RefsFilename())
+}
+
+//Refs returns the listing of refs of a snapshot
+func (ss *snapshotStore) Refs(s *Snapshot) ([]byte, error) {
+	return ioutil.ReadFile(ss.RefsPath(s))
+}
+
+//SaveRefs keeps the listing of refs of a snapshot such that it can be
+//served to other members, it fails if the listing doesn't match
+func (ss *snapshotStore) SaveRefs(s *Snapshot, listing []byte) ([]SnapshotRef, error) {
+	refs, err := ParseSnapshotRefs(s.ID, listing)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(ss.Dir(s.Repo), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	return refs, ss.write(ss.RefsPath(s), listing)
+}
+
+//write writes data next to its final path and renames it when
+//complete such that readers never see a partial file
+func (ss *snapshotStore) write(path string, data []byte) error {
+	tmp := fmt.Sprintf("%s.tmp", path)
+	err := ioutil.WriteFile(tmp, data, 0666)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+//latest returns the most recent snapshot of which the refs are
+//known, it is the base of the delta of the next snapshot
+func (ss *snapshotStore) latest(repo string) (string, []SnapshotRef) {
+	fis, err := ioutil.ReadDir(ss.Dir(repo))
+	if err != nil {
+		return "", nil
+	}
+
+	var newest os.FileInfo
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), ".refs") && (newest == nil || fi.ModTime().After(newest.ModTime())) {
+			newest = fi
+		}
+	}
+
+	if newest == nil {
+		return "", nil
+	}
+
+	s := &Snapshot{Repo: repo, ID: strings.TrimSuffix(newest.Name(), ".refs")}
+	listing, err := ss.Refs(s)
+	if err != nil {
+		return "", nil
+	}
+
+	refs, err := ParseSnapshotRefs(s.ID, listing)
+	if err != nil {
+		return "", nil
+	}
+
+	return s.ID, refs
+}
+
+//bundle writes a bundle next to its final path and renames
+//it when complete such that bundles on disk are never partial
+func (ss *snapshotStore) bundle(repopath, path string, revs ...string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	tmp := fmt.Sprintf("%s.tmp", path)
+	_, err := git(repopath, append([]string{"bundle", "create", tmp}, revs...)...)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+//Create bundles the branches and tags of the repository as they are
+//now, if an earlier snapshot is known an incremental bundle from its
+//refs is created as well
+func (ss *snapshotStore) Create(repo, repopath string) (*Snapshot, error) {
+	l := ss.lock(repo)
+	l.Lock()
+	defer l.Unlock()
+
+	commit, err := headCommit(repopath)
+	if err != nil {
+		return nil, err
+	}
+
+	base, baseRefs := ss.latest(repo)
+	listing, err := snapshotListing(repopath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{Repo: repo, ID: snapshotID(listing), Commit: commit}
+	refs, err := ss.SaveRefs(s, listing)
+	if err != nil {
+		return nil, err
+	}
+
+	//refs that are updated while bundling end up in the next snapshot
+	revs := []string{"--branches", "--tags"}
+	for _, ref := range refs {
+		if ref.Name == originNotes {
+			revs = append(revs, originNotes)
+		}
+	}
+
+	err = ss.bundle(repopath, ss.Path(s), revs...)
+	if err != nil {
+		return nil, err
+	}
+
+	if base == "" || base == s.ID || !hasRefs(repopath, baseRefs) {
+		return s, nil
+	}
+
+	//a delta is only an optimization, without it members fall back to the full bundle
+	s.Base = base
+	for _, ref := range baseRefs {
+		revs = append(revs, fmt.Sprintf("^%s", ref.Object))
+	}
+
+	err = ss.bundle(repopath, ss.DeltaPath(s), revs...)
+	if err != nil {
+		log.Printf("Failed to create delta of '%s' from '%s' to '%s', only offering full snapshot: %s", repo, base, s.ID, err)
+		s.Base = ""
+	}
+
+	return s, nil
+}
+
+//Size returns the number of bytes members need to transfer
+//when they have the base of the snapshot
+func (ss *snapshotStore) Size(s *Snapshot) (int64, error) {
+	path := ss.Path(s)
+	if s.Base != "" {
+		path = ss.DeltaPath(s)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+//Import verifies a downloaded full or delta bundle and fetches its
+//branches as the remote-tracking branches of its origin, a delta
+//fails to verify when the repository doesn't have its base
+func (ss *snapshotStore) Import(s *Snapshot, path, repopath string) error {
+	err := initRepo(repopath)
+	if err != nil {
+		return err
+	}
+
+	_, err = git(repopath, "bundle", "verify", path)
+	if err != nil {
+		return err
+	}
+
+	_, err = git(repopath, "fetch", path, fmt.Sprintf("+refs/heads/*:%s*", remoteRefs(s.Origin)), "+refs/tags/*:refs/tags/*", fmt.Sprintf("+refs/notes/*:%s*", remoteNotes(s.Origin)))
+	return err
+}
+
+//Apply points the remote-tracking branches and notes of the origin and
+//the tags to what the snapshot lists, the repository must have every
+//ref tip
+func (ss *snapshotStore) Apply(s *Snapshot, repopath string, refs []SnapshotRef) error {
+	updates := &bytes.Buffer{}
+	for _, ref := range refs {
+		name := ref.Name
+		switch {
+		case strings.HasPrefix(name, "refs/heads/"):
+			name = remoteRefs(s.Origin) + strings.TrimPrefix(name, "refs/heads/")
+		case strings.HasPrefix(name, "refs/notes/"):
+			name = remoteNotes(s.Origin) + strings.TrimPrefix(name, "refs/notes/")
+		case !strings.HasPrefix(name, "refs/tags/"):
+			continue
+		}
+
+		fmt.Fprintf(updates, "update %s %s\n", name, ref.Object)
+	}
+
+	cmd := exec.Command("git", "update-ref", "--stdin")
+	cmd.Dir = repopath
+	cmd.Stdin = updates
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to update refs of '%s' to snapshot '%s': %s", s.Repo, s.ID, err)
+	}
+
+	return nil
+}
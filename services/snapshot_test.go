@@ -0,0 +1,74 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotOfTagOnlyPush(t *testing.T) {
+	dir := testDir(t)
+	repopath := filepath.Join(dir, "repo")
+	commits := testCommits(t, repopath, 2)
+	ss, err := NewSnapshotStore(filepath.Join(dir, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ss.Create("repo", repopath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = git(repopath, "tag", "v1", commits[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := ss.Create("repo", repopath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.ID == second.ID || first.Commit != second.Commit {
+		t.Fatalf("expected a new snapshot at the same head, got '%s' and '%s'", first.ID, second.ID)
+	}
+
+	listing, err := ss.Refs(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := ParseSnapshotRefs(second.ID, listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs) != 2 || refs[1].Name != "refs/tags/v1" || refs[1].Object != commits[0] {
+		t.Errorf("expected the branch and the tag, got: %v", refs)
+	}
+
+	_, err = ParseSnapshotRefs(first.ID, listing)
+	if err == nil {
+		t.Errorf("expected refs of another snapshot to be rejected")
+	}
+
+	_, err = git(repopath, "-c", "user.name=test", "-c", "user.email=test@cellstate", "commit", "-q", "--allow-empty", "-m", "empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	third, err := ss.Create("repo", repopath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if third.Base != second.ID {
+		t.Errorf("expected the previous snapshot to be the base of the delta, got: '%s'", third.Base)
+	}
+
+	other := filepath.Join(dir, "other")
+	testCommits(t, other, 1)
+	if hasRefs(other, refs) || !hasRefs(repopath, refs) {
+		t.Errorf("expected only the repository with every ref tip to have the refs")
+	}
+}
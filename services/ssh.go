@@ -0,0 +1,364 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//AuthorizedKey is a public key that may push and fetch over ssh on
+//any member, keys are replicated to all members of the cluster
+type AuthorizedKey struct {
+	Fingerprint string `json:"fingerprint"`
+	Name        string `json:"name"`
+	Key         string `json:"key"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+//RepoFunc returns the path of the repository a user asked for and
+//checks if the user may read it or, for write, push to it
+type RepoFunc func(repo, user string, write bool) (repopath string, err error)
+
+func NewSSHServer(bind, hostKeyPath string, keys *replicatedSet, repo RepoFunc) (*sshServer, error) {
+	signer, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &sshServer{
+		bind: bind,
+		keys: keys,
+		repo: repo,
+	}
+
+	ss.config = &ssh.ServerConfig{PublicKeyCallback: ss.authorize}
+	ss.config.AddHostKey(signer)
+	return ss, nil
+}
+
+//ssh server lets git clients push and fetch over ssh, e.g. with
+//'git@<member>:<repo>'. It only runs upload-pack and receive-pack
+type sshServer struct {
+	bind     string
+	keys     *replicatedSet
+	repo     RepoFunc
+	config   *ssh.ServerConfig
+	listener net.Listener
+	receive  []ReceiveFunc
+}
+
+//loadHostKey reads the host key of the node, it is created on first
+//use such that clients see the same key after a restart
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Generated new ssh host key '%s'", path)
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewSignerFromKey(key)
+}
+
+//OnReceive registers a func that is called after every push
+func (ss *sshServer) OnReceive(fn ReceiveFunc) {
+	ss.receive = append(ss.receive, fn)
+}
+
+//authorize accepts keys that were added to the cluster
+func (ss *sshServer) authorize(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	k := &AuthorizedKey{}
+	fp := ssh.FingerprintSHA256(key)
+	if !ss.keys.Get(fp, k) {
+		return nil, fmt.Errorf("Unknown public key '%s'", fp)
+	}
+
+	return &ssh.Permissions{Extensions: map[string]string{"key": fp, "name": k.Name}}, nil
+}
+
+func (ss *sshServer) Start() error {
+	var err error
+	ss.listener, err = net.Listen("tcp", ss.bind)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Printf("SSH server listening on '%s'...", ss.bind)
+		for {
+			nc, err := ss.listener.Accept()
+			if err != nil {
+				if !strings.Contains(err.Error(), "closed network connection") {
+					log.Printf("SSH server failed: %s", err)
+				}
+
+				return
+			}
+
+			go ss.serveConn(nc)
+		}
+	}()
+
+	return nil
+}
+
+func (ss *sshServer) Stop() error {
+	return ss.listener.Close()
+}
+
+func (ss *sshServer) serveConn(nc net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, ss.config)
+	if err != nil {
+		log.Printf("SSH handshake with '%s' failed: %s", nc.RemoteAddr(), err)
+		nc.Close()
+		return
+	}
+
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "Only sessions are supported")
+			continue
+		}
+
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			log.Printf("Failed to accept ssh channel: %s", err)
+			continue
+		}
+
+		go ss.serveSession(conn, ch, reqs)
+	}
+}
+
+//serveSession runs the single git command of a session, git passes
+//the protocol version as an environment variable before it
+func (ss *sshServer) serveSession(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	env := []string{}
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			v := struct{ Name, Value string }{}
+			err := ssh.Unmarshal(req.Payload, &v)
+			if err != nil || v.Name != "GIT_PROTOCOL" {
+				req.Reply(false, nil)
+				continue
+			}
+
+			env = append(env, fmt.Sprintf("GIT_PROTOCOL=%s", v.Value))
+			req.Reply(true, nil)
+		case "exec":
+			v := struct{ Command string }{}
+			err := ssh.Unmarshal(req.Payload, &v)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			req.Reply(true, nil)
+			status := ss.exec(conn, ch, v.Command, env)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+//parseGitCommand returns the service and the path of the repository
+//of a command such as "git-receive-pack '/my-data.git'"
+func parseGitCommand(command string) (service string, path string, err error) {
+	parts := strings.SplitN(command, " ", 2)
+	if len(parts) != 2 || (parts[0] != "git-upload-pack" && parts[0] != "git-receive-pack") {
+		return "", "", fmt.Errorf("Only git-upload-pack and git-receive-pack are supported")
+	}
+
+	path = strings.TrimSpace(parts[1])
+	if len(path) > 1 && path[0] == '\'' && path[len(path)-1] == '\'' {
+		path = path[1 : len(path)-1]
+	}
+
+	if strings.ContainsAny(path, "'\"") {
+		return "", "", fmt.Errorf("Invalid repository '%s'", parts[1])
+	}
+
+	return parts[0], "/" + strings.TrimLeft(strings.TrimPrefix(path, "~"), "/"), nil
+}
+
+//exec runs a git service with the channel as its stdio and returns
+//the exit status, refs are compared afterwards to report a push
+func (ss *sshServer) exec(conn *ssh.ServerConn, ch ssh.Channel, command string, env []string) uint32 {
+	service, path, err := parseGitCommand(command)
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "%s\n", err)
+		return 1
+	}
+
+	name, err := ParseRepoName(path)
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "%s\n", err)
+		return 1
+	}
+
+	repopath, err := ss.repo(name, conn.Permissions.Extensions["name"], service == "git-receive-pack")
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "%s\n", err)
+		return 1
+	}
+
+	log.Printf("Running '%s' in '%s' for key '%s' of '%s'", service, name, conn.Permissions.Extensions["key"], conn.Permissions.Extensions["name"])
+	before, err := listRefs(repopath)
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "%s\n", err)
+		return 1
+	}
+
+	cmd := exec.Command("git", strings.TrimPrefix(service, "git-"), ".")
+	cmd.Dir = repopath
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+
+	//the client doesn't always close its side, copying it in the
+	//background keeps us from waiting on it after git exited
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "%s\n", err)
+		return 1
+	}
+
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+
+	err = cmd.Run()
+	if err != nil {
+		log.Printf("Failed to run '%s' in '%s': %s", service, repopath, err)
+		if exit, ok := err.(*exec.ExitError); ok {
+			return uint32(exit.ExitCode())
+		}
+
+		return 1
+	}
+
+	if service != "git-receive-pack" {
+		return 0
+	}
+
+	after, err := listRefs(repopath)
+	if err != nil {
+		log.Printf("Failed to list refs of '%s' after push: %s", name, err)
+		return 0
+	}
+
+	updates := diffRefs(before, after)
+	if len(updates) == 0 {
+		return 0
+	}
+
+	for _, fn := range ss.receive {
+		fn(name, repopath, updates)
+	}
+
+	return 0
+}
+
+//diffRefs returns the updates that turn one set of refs into another
+func diffRefs(before, after map[string]string) []RefUpdate {
+	updates := []RefUpdate{}
+	for ref, commit := range after {
+		if old, ok := before[ref]; !ok {
+			updates = append(updates, RefUpdate{Ref: ref, Old: zeroID, New: commit})
+		} else if old != commit {
+			updates = append(updates, RefUpdate{Ref: ref, Old: old, New: commit})
+		}
+	}
+
+	for ref, old := range before {
+		if _, ok := after[ref]; !ok {
+			updates = append(updates, RefUpdate{Ref: ref, Old: old, New: zeroID})
+		}
+	}
+
+	return updates
+}
+
+//AddKey authorizes a public key in the authorized_keys format on all
+//members, name identifies who the key belongs to
+func (ac *gitServer) AddKey(name string, line []byte) (*AuthorizedKey, error) {
+	pk, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse public key: %s", err)
+	}
+
+	k := &AuthorizedKey{
+		Fingerprint: ssh.FingerprintSHA256(pk),
+		Name:        name,
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk))),
+		Comment:     comment,
+	}
+
+	err = ac.keys.Put(k.Fingerprint, k)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, ac.gossipSet(ac.keys)
+}
+
+//RemoveKey revokes a key by its fingerprint on all members
+func (ac *gitServer) RemoveKey(fingerprint string) error {
+	ok, err := ac.keys.Delete(fingerprint)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("No key with fingerprint '%s'", fingerprint)
+	}
+
+	return ac.gossipSet(ac.keys)
+}
+
+//Keys returns all authorized keys
+func (ac *gitServer) Keys() []*AuthorizedKey {
+	keys := []*AuthorizedKey{}
+	for _, fp := range ac.keys.IDs() {
+		k := &AuthorizedKey{}
+		if ac.keys.Get(fp, k) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
@@ -5,49 +5,284 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"net/http/cgi"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Storage interface {
 	Start() error
 	Stop() error
+	Pull(s *Snapshot) error
+	PullObject(o *LFSObject) error
+	Resume()
 }
 
-func NewGitServer(exchange Exchange, gossip Gossip, ip net.IP) (*gitServer, error) {
-	h := &cgi.Handler{
-		Path: "/usr/lib/git-core/git-http-backend",
-		Root: "/git/",
-		Env:  []string{"GIT_PROJECT_ROOT=/tmp", "GIT_HTTP_EXPORT_ALL=1", "REMOTE_USER=cell"},
+type StorageConf struct {
+	Port int
+	Data *DataDir
+
+	//updates smaller than this are fetched over git
+	FetchThreshold int64
+
+	//when set the exchange transfers git objects straight into
+	//repositories instead of bundle files
+	ObjectTransfer bool
+
+	//number of snapshots kept per repository and how often garbage
+	//is collected in the background, zero disables the background gc
+	KeepSnapshots int
+	GCInterval    time.Duration
+
+	//port of the ssh server git clients can use instead of http,
+	//zero disables it
+	SSHPort int
+
+	//signs requests for state that is replicated between members
+	Auth *ClusterAuth
+
+	//whether a push creates the repository when it doesn't exist,
+	//otherwise repositories are created with 'cell repo create'
+	AutoCreate bool
+
+	//name of this member in the gossip, snapshots carry it as their
+	//origin and other members track its branches under it
+	Node string
+
+	//shared with the exchange, limits what is served and fetched
+	Bandwidth *Bandwidth
+}
+
+func NewGitServer(conf StorageConf, exchange Exchange, gossip Gossip, ip net.IP) (*gitServer, error) {
+	snapshots, err := NewSnapshotStore(conf.Data.Snapshots())
+	if err != nil {
+		return nil, err
+	}
+
+	bw := conf.Bandwidth
+	if bw == nil {
+		bw = NewBandwidth(TransferLimits{})
+	}
+
+	//requests to members are signed and limited like all transfers
+	client := &http.Client{Transport: conf.Auth.Transport(&limitedTransport{bw: bw})}
+	chunks, err := NewChunkStore(conf.Data.Chunks(), client)
+	if err != nil {
+		return nil, err
+	}
+
+	lfs, err := NewLFSStore(conf.Data.LFS())
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := NewJournal(filepath.Join(conf.Data.Transfers(), "journal.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	trees, err := NewTreeStore(conf.Data.Trees())
+	if err != nil {
+		return nil, err
+	}
+
+	smart, err := NewSmartHTTP()
+	if err != nil {
+		return nil, err
 	}
 
-	return &gitServer{
-		exchange: exchange,
-		gossip:   gossip,
-		port:     3838,
-		ip:       ip,
-		cgih:     h,
-	}, nil
+	keys, err := NewReplicatedSet("keys", filepath.Join(conf.Data.Access(), "keys.json"), conf.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	declared, err := NewReplicatedSet("repos", filepath.Join(conf.Data.Access(), "repos.json"), conf.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	ac := &gitServer{
+		exchange:  exchange,
+		gossip:    gossip,
+		snapshots: snapshots,
+		chunks:    chunks,
+		lfs:       lfs,
+		journal:   journal,
+		trees:     trees,
+		port:      conf.Port,
+		node:      conf.Node,
+		root:      conf.Data.Repos(),
+		threshold: conf.FetchThreshold,
+		objects:   conf.ObjectTransfer,
+		keep:      conf.KeepSnapshots,
+		gcEvery:   conf.GCInterval,
+		create:    conf.AutoCreate,
+		stop:      make(chan struct{}),
+		ip:        ip,
+		smart:     smart,
+		auth:      conf.Auth,
+		bandwidth: bw,
+		client:    client,
+		keys:      keys,
+		declared:  declared,
+		sets:      map[string]*replicatedSet{keys.name: keys, declared.name: declared},
+		pending:   map[string]*pendingSnapshot{},
+
+		pendingObjects: map[string][]*LFSObject{},
+		publishing:     map[string]bool{},
+		queued:         map[string]bool{},
+	}
+
+	ac.access, err = NewAccessControl(conf.Data.Access(), conf.Auth, ac.gossipSet)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rs := range ac.access.Sets() {
+		ac.sets[rs.name] = rs
+	}
+
+	exchange.OnComplete(ac.complete)
+	exchange.OnComplete(ac.completeObject)
+	smart.OnReceive(ac.received)
+	if conf.SSHPort > 0 {
+		ac.ssh, err = NewSSHServer(net.JoinHostPort(ip.String(), strconv.Itoa(conf.SSHPort)), filepath.Join(conf.Data.Root, "ssh_host_key"), keys, ac.repo)
+		if err != nil {
+			return nil, err
+		}
+
+		ac.ssh.OnReceive(ac.received)
+	}
+
+	return ac, nil
 }
 
 type gitServer struct {
-	exchange Exchange
-	gossip   Gossip
-	port     int
-	ip       net.IP
-	cgih     *cgi.Handler
+	exchange  Exchange
+	gossip    Gossip
+	snapshots *snapshotStore
+	chunks    *chunkStore
+	lfs       *lfsStore
+	journal   *journal
+	trees     *treeStore
+	port      int
+	node      string
+	root      string
+	threshold int64
+	objects   bool
+	keep      int
+	gcEvery   time.Duration
+	create    bool
+	stop      chan struct{}
+	ip        net.IP
+	smart     *smartHTTP
+	ssh       *sshServer
+	auth      *ClusterAuth
+	bandwidth *Bandwidth
+	client    *http.Client
+	proxy     net.Listener
+	keys      *replicatedSet
+	declared  *replicatedSet
+	access    *accessControl
+	sets      map[string]*replicatedSet
+
+	notesMu        sync.Mutex
+	mu             sync.Mutex
+	pending        map[string]*pendingSnapshot
+	pendingObjects map[string][]*LFSObject
+	publishing     map[string]bool
+	queued         map[string]bool
+	unsubscribe    func()
+}
+
+//a snapshot that is being transferred, either the full bundle,
+//the delta or, with object transfer, the objects of its commit
+type pendingSnapshot struct {
+	*Snapshot
+	path  string
+	delta bool
 }
 
 func (ac *gitServer) Stop() error {
+	close(ac.stop)
+	if ac.unsubscribe != nil {
+		ac.unsubscribe()
+	}
+
+	if ac.proxy != nil {
+		ac.proxy.Close()
+	}
+
+	if ac.ssh != nil {
+		return ac.ssh.Stop()
+	}
+
 	return nil
 }
 
 func (ac *gitServer) Start() error {
+	var updates <-chan Transfer
+	updates, ac.unsubscribe = ac.exchange.Subscribe()
+	go func() {
+		for t := range updates {
+			if t.Error != "" {
+				ac.failed(t)
+			}
+		}
+	}()
+
+	if ac.gcEvery > 0 {
+		go func() {
+			for {
+				select {
+				case <-ac.stop:
+					return
+				case <-time.After(ac.gcEvery):
+				}
+
+				_, err := ac.GC()
+				if err != nil {
+					log.Printf("Garbage collection failed: %s", err)
+				}
+			}
+		}()
+	}
+
+	if !ac.access.HasUsers() {
+		log.Printf("Warning: no users configured, git clients are refused until the first user is added with 'cell user add'")
+	}
+
+	//trees may be missing or behind when the daemon stopped
+	//in the middle of an update
 	go func() {
-		bind := fmt.Sprintf("%s:%d", ac.ip.String(), ac.port)
+		repos, err := ac.repos()
+		if err != nil {
+			log.Printf("Failed to list repositories: %s", err)
+			return
+		}
+
+		for _, name := range repos {
+			ac.updateTree(name)
+		}
+	}()
+
+	if ac.ssh != nil {
+		err := ac.ssh.Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := ac.startProxy()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		bind := net.JoinHostPort(ac.ip.String(), strconv.Itoa(ac.port))
 		log.Printf("HTTP server listening on '%s'...", bind)
 		log.Printf("REMOTE: 'git remote add origin http://%s/test.git'", bind)
 		err := http.ListenAndServe(bind, ac)
@@ -59,69 +294,506 @@ func (ac *gitServer) Start() error {
 	return nil
 }
 
+//serveSeed serves snapshots that completed their transfer as plain
+//files such that members can use us as a web seed (BEP 19) when no
+//peer is reachable, the file server handles range requests
+func (ac *gitServer) serveSeed(w http.ResponseWriter, r *http.Request) {
+	name := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/seed/"), "/", 2)[0]
+	for _, t := range ac.exchange.Transfers() {
+		if t.Done && t.Name == name && strings.HasPrefix(t.Dir, ac.snapshots.root) {
+			http.StripPrefix("/seed", http.FileServer(http.Dir(t.Dir))).ServeHTTP(w, r)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+//outsideWindow refuses data that members replicate when no transfer
+//window is open, they fetch it again later. Users are always served
+func (ac *gitServer) outsideWindow(w http.ResponseWriter) bool {
+	if ac.bandwidth.Open(time.Now()) {
+		return false
+	}
+
+	http.Error(w, "Outside of transfer window", http.StatusServiceUnavailable)
+	return true
+}
+
 func (ac *gitServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	res := []string{}
-	for _, p := range parts {
-		if p == "" {
-			continue
+	//everything served takes from the same rates as the exchange
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	w = &limitedResponse{ResponseWriter: w, w: &limitedWriter{w: w, limiters: ac.bandwidth.uploadTo(host)}}
+	if r.Body != nil {
+		r.Body = &limitedBody{Reader: &limitedReader{r: r.Body, limiters: ac.bandwidth.downloadFrom(host)}, Closer: r.Body}
+	}
+
+	//snapshots hold every branch of a repository, only members that
+	//receive them anyway may fetch them
+	if strings.HasPrefix(r.URL.Path, "/seed/") {
+		if ac.outsideWindow(w) {
+			return
+		}
+
+		ac.auth.Require(http.HandlerFunc(ac.serveSeed)).ServeHTTP(w, r)
+		return
+	}
+
+	//users upload and download large files with 'cell chunk'
+	if strings.HasPrefix(r.URL.Path, "/chunks/") {
+		if user, ok := ac.access.Authenticate(r); ok && user != memberUser {
+			http.StripPrefix("/chunks", ac.chunks).ServeHTTP(w, r)
+			return
+		}
+
+		if ac.outsideWindow(w) {
+			return
+		}
+
+		ac.auth.Require(http.StripPrefix("/chunks", ac.chunks)).ServeHTTP(w, r)
+		return
+	}
+
+	if r.URL.Path == "/has" {
+		ac.auth.Require(http.HandlerFunc(ac.serveHas)).ServeHTTP(w, r)
+		return
+	}
+
+	if r.URL.Path == "/refs" {
+		ac.auth.Require(http.HandlerFunc(ac.serveRefs)).ServeHTTP(w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/sets/") {
+		ac.serveSet(w, r)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/lfs/objects/") {
+		if ac.outsideWindow(w) {
+			return
+		}
+
+		ac.auth.Require(http.HandlerFunc(ac.serveLocalObject)).ServeHTTP(w, r)
+		return
+	}
+
+	//git-lfs talks to '<remote>/info/lfs'
+	if i := strings.Index(r.URL.Path, "/info/lfs/"); i >= 0 {
+		name, err := ParseRepoName(r.URL.Path[:i])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, ok := ac.access.Authenticate(r)
+		if !ok || !ac.access.Allowed(user, name, r.Method == "PUT") {
+			ac.deny(w, user)
+			return
+		}
+
+		ac.serveLFS(w, r, name, r.URL.Path[:i], r.URL.Path[i+len("/info/lfs/"):])
+		return
+	}
+
+	repo, endpoint, ok := splitSmartPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	name, err := ParseRepoName(repo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := ac.access.Authenticate(r)
+	if !ok {
+		ac.deny(w, user)
+		return
+	}
+
+	if user == memberUser && ac.outsideWindow(w) {
+		return
+	}
+
+	write := endpoint == "/git-receive-pack" || r.URL.Query().Get("service") == "git-receive-pack"
+	repopath, err := ac.repo(name, user, write)
+	if err == ErrAccessDenied {
+		ac.deny(w, user)
+		return
+	} else if err == ErrRepoNotFound {
+		http.Error(w, fmt.Sprintf("Repository '%s' doesn't exist, create it with 'cell repo create'", name), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ac.smart.Serve(w, r, name, repopath, endpoint)
+}
+
+//deny responds to a request that isn't allowed, clients that didn't
+//authenticate are asked to
+func (ac *gitServer) deny(w http.ResponseWriter, user string) {
+	if user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cellstate"`)
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("User '%s' has no access", user), http.StatusForbidden)
+}
+
+//received queues a snapshot of the new state of a repository after a push
+func (ac *gitServer) received(name, repopath string, updates []RefUpdate) {
+	pushed := []string{}
+	for _, u := range updates {
+		log.Printf("Push to '%s' updated '%s' from '%s' to '%s'", name, u.Ref, u.Old, u.New)
+		if u.New != zeroID && strings.HasPrefix(u.Ref, "refs/heads/") {
+			pushed = append(pushed, u.New)
 		}
-		res = append(res, p)
-		if strings.HasSuffix(p, ".git") {
-			break
+	}
+
+	ac.notePushed(repopath, pushed)
+	go ac.updateTree(name)
+	ac.queuePublish(name, repopath)
+}
+
+//queuePublish publishes a repository in the background such that
+//pushes don't wait for snapshots. Pushes that arrive while it is
+//published are published together afterwards
+func (ac *gitServer) queuePublish(name, repopath string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.publishing[name] {
+		ac.queued[name] = true
+		return
+	}
+
+	ac.publishing[name] = true
+	go func() {
+		for {
+			log.Printf("Detected new git commits in '%s', emitting event...", name)
+			err := ac.publish(name, repopath)
+			if err != nil {
+				log.Printf("Failed to publish snapshot of '%s': %s", name, err)
+			}
+
+			ac.mu.Lock()
+			ok := ac.queued[name]
+			delete(ac.queued, name)
+			if !ok {
+				delete(ac.publishing, name)
+			}
+
+			ac.mu.Unlock()
+			if !ok {
+				return
+			}
 		}
+	}()
+}
+
+//publish creates an immutable snapshot of the repository, starts
+//seeding it and gossips its presence to other members
+func (ac *gitServer) publish(name, repopath string) error {
+	s, err := ac.snapshots.Create(name, repopath)
+	if err != nil {
+		return err
 	}
 
-	name := strings.Join(res, "")
+	s.Origin = ac.node
 
-	//create directory and init repo if it doesn't exit yet
-	repopath := string(filepath.Separator) + filepath.Join("tmp", name)
+	s.Size, err = ac.snapshots.Size(s)
+	if err != nil {
+		return err
+	}
 
-	log.Printf("we got res '%s', and name '%s' and repopath '%s'", res, name, repopath)
-	if _, err := os.Stat(repopath); os.IsNotExist(err) {
+	//small updates are fetched over git from the nearest member
+	//that has them, setting up a torrent isn't worth it
+	if s.Size < ac.threshold {
+		log.Printf("Snapshot of '%s' of '%s' is %d bytes, gossip it without links", s.ID, s.Repo, s.Size)
+		return ac.gossip.EmitSnapshot(s)
+	}
 
-		err := os.MkdirAll(repopath, 0777)
+	if ac.objects {
+		s.Link, err = ac.exchange.CreateLink(s.Repo, repopath)
 		if err != nil {
-			log.Printf("Failed to create directory path '%s': '%s'", repopath, err)
+			return err
 		}
 
-		cmd := exec.Command("git", "--bare", "init")
-		cmd.Dir = repopath
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+		log.Printf("Gossip new snapshot '%s' of '%s' with object link: %s", s.ID, s.Repo, s.Link)
+		return ac.gossip.EmitSnapshot(s)
+	}
+
+	//create a magnet link for the snapshot
+	s.Link, err = ac.exchange.CreateLink(s.Filename(), ac.snapshots.Path(s))
+	if err != nil {
+		return err
+	}
+
+	//start seeding newly created snapshot
+	log.Printf("Got new link: %s, start seeding", s.Link)
+	err = ac.exchange.SeedLink(s.Link, ac.snapshots.Dir(s.Repo))
+	if err != nil {
+		return err
+	}
+
+	if s.Base != "" {
+		s.Delta, err = ac.exchange.CreateLink(s.DeltaFilename(), ac.snapshots.DeltaPath(s))
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Got new delta link: %s, start seeding", s.Delta)
+		err = ac.exchange.SeedLink(s.Delta, ac.snapshots.Dir(s.Repo))
 		if err != nil {
-			log.Printf("Failed init bare repo: '%s'", err)
+			return err
 		}
 	}
 
-	//let git cgi script handle the actual file writing
-	ac.cgih.ServeHTTP(w, r)
+	//gossip new snapshot
+	log.Printf("Gossip new snapshot '%s' of '%s'...", s.ID, s.Repo)
+	return ac.gossip.EmitSnapshot(s)
+}
+
+//Pull starts downloading a snapshot that was gossiped by another
+//member, it is imported once the exchange completes the transfer
+func (ac *gitServer) Pull(s *Snapshot) error {
+	if !validRepoName(s.Repo) {
+		return fmt.Errorf("Invalid repository name '%s' in snapshot", s.Repo)
+	}
 
-	//when it was a post with git receive, emit a new torrent to be downloaded
-	if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "git-receive-pack") {
-		log.Printf("Detected new git commits: %s %s, emitting event...", r.Method, r.URL.String())
+	if !validOrigin(s.Origin) {
+		return fmt.Errorf("Invalid origin '%s' in snapshot", s.Origin)
+	}
 
-		//create torrent file and publish on fileserver
-		turl, err := ac.exchange.CreateLink(name, repopath)
+	if !validObjectName(s.ID) || (s.Base != "" && !validObjectName(s.Base)) {
+		return fmt.Errorf("Invalid id '%s' in snapshot", s.ID)
+	}
+
+	//gossip delivers our own snapshots as well
+	if s.Origin == ac.node {
+		return nil
+	}
+
+	//the journal keeps the snapshot until its refs are in the repository
+	err := ac.journal.Add(snapshotKey(s), &JournalEntry{Snapshot: s})
+	if err != nil {
+		return err
+	}
+
+	refs, err := ac.snapshotRefs(s)
+	if err != nil {
+		return err
+	}
+
+	repopath := filepath.Join(ac.root, s.Repo)
+	if hasRefs(repopath, refs) {
+		log.Printf("Repository '%s' already has every ref of snapshot '%s', skipping transfer", s.Repo, s.ID)
+		before := refTips(repopath)
+		err = ac.snapshots.Apply(s, repopath, refs)
 		if err != nil {
-			log.Printf("Failed to create exchange link for repopath '%s': %s", repopath, err)
-			return
+			return err
+		}
+
+		ac.imported(s, before)
+		return nil
+	}
+
+	if s.Link == "" {
+		go func() {
+			err := ac.fetch(s)
+			if err != nil {
+				log.Printf("Failed to fetch snapshot '%s' of '%s' over git: %s", s.ID, s.Repo, err)
+			}
+		}()
+
+		return nil
+	}
+
+	if ac.objects {
+		return ac.pull(&pendingSnapshot{Snapshot: s, path: repopath})
+	}
+
+	//only fetch what is missing when we have every ref of the base
+	if s.Delta != "" {
+		base, err := ac.snapshotRefs(&Snapshot{Repo: s.Repo, ID: s.Base})
+		if err == nil && hasRefs(repopath, base) {
+			return ac.pull(&pendingSnapshot{Snapshot: s, path: ac.snapshots.DeltaPath(s), delta: true})
+		}
+	}
+
+	return ac.pull(&pendingSnapshot{Snapshot: s, path: ac.snapshots.Path(s)})
+}
+
+//Resume pulls what the journal recorded before a restart, it is
+//called once the gossip is joined such that members can provide
+func (ac *gitServer) Resume() {
+	ac.syncSets()
+	for _, e := range ac.journal.Entries() {
+		var err error
+		switch {
+		case e.Snapshot != nil:
+			log.Printf("Resuming pull of snapshot '%s' of '%s'...", e.Snapshot.ID, e.Snapshot.Repo)
+			err = ac.Pull(e.Snapshot)
+		case e.Object != nil:
+			log.Printf("Resuming pull of lfs object '%s' of '%s'...", e.Object.Oid, e.Object.Repo)
+			err = ac.PullObject(e.Object)
 		}
 
-		//start seeding newly created torrent
-		log.Printf("Got new link: %s, start seeding", turl)
-		err = ac.exchange.SeedLink(turl, filepath.Dir(repopath))
 		if err != nil {
-			log.Printf("Failed to start seeding '%s': %s", turl, err)
-			return
+			log.Printf("Failed to resume pull: %s", err)
 		}
+	}
+}
+
+func (ac *gitServer) pull(ps *pendingSnapshot) error {
+	link := ps.Link
+	if ps.delta {
+		link = ps.Delta
+	}
+
+	ac.mu.Lock()
+	ac.pending[link] = ps
+	ac.mu.Unlock()
 
-		//gossip new torrent
-		log.Printf("Gossip new torrent...")
-		err = ac.gossip.EmitTorrent(turl)
+	dir := ac.snapshots.Dir(ps.Repo)
+	if ac.objects {
+		dir = ps.path
+	}
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+
+	return ac.exchange.Pull(link, dir)
+}
+
+//complete imports pending snapshots when their transfer is done
+func (ac *gitServer) complete(t Transfer) {
+	ac.mu.Lock()
+	ps, ok := ac.pending[t.Link]
+	delete(ac.pending, t.Link)
+	ac.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	//the objects are present already, fetching refs from a member
+	//that has the commit only negotiates and updates them
+	if ac.objects {
+		err := ac.fetch(ps.Snapshot)
 		if err != nil {
-			log.Fatalf("Failed to gossip torrent url '%s': %s", turl, err)
+			log.Printf("Failed to update refs of '%s' to snapshot '%s': %s", ps.Repo, ps.ID, err)
+		}
+
+		return
+	}
+
+	repopath := filepath.Join(ac.root, ps.Repo)
+	before := refTips(repopath)
+	log.Printf("Importing snapshot '%s' of '%s' (delta: %t)...", ps.ID, ps.Repo, ps.delta)
+	err := ac.snapshots.Import(ps.Snapshot, ps.path, repopath)
+	if err == nil {
+		ac.imported(ps.Snapshot, before)
+	} else {
+		log.Printf("Failed to import snapshot '%s' of '%s': %s", ps.ID, ps.Repo, err)
+		ac.fallback(ps)
+	}
+}
+
+//failed forgets snapshots and objects of which the transfer failed,
+//they are pulled again when gossiped again
+func (ac *gitServer) failed(t Transfer) {
+	ac.mu.Lock()
+	ps, ok := ac.pending[t.Link]
+	delete(ac.pending, t.Link)
+	delete(ac.pendingObjects, t.Link)
+	ac.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	log.Printf("Transfer of snapshot '%s' of '%s' failed: %s", ps.ID, ps.Repo, t.Error)
+	ac.fallback(ps)
+}
+
+//fallback pulls the full snapshot when a delta couldn't be used
+func (ac *gitServer) fallback(ps *pendingSnapshot) {
+	if !ps.delta {
+		return
+	}
+
+	log.Printf("Falling back to the full snapshot '%s' of '%s'", ps.ID, ps.Repo)
+	err := ac.pull(&pendingSnapshot{Snapshot: ps.Snapshot, path: ac.snapshots.Path(ps.Snapshot)})
+	if err != nil {
+		log.Printf("Failed to pull full snapshot '%s' of '%s': %s", ps.ID, ps.Repo, err)
+	}
+}
+
+//Access returns the access control of git clients
+func (ac *gitServer) Access() *accessControl {
+	return ac.access
+}
+
+//serveSet serves a replicated set to members
+func (ac *gitServer) serveSet(w http.ResponseWriter, r *http.Request) {
+	rs, ok := ac.sets[strings.TrimPrefix(r.URL.Path, "/sets/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	ac.auth.Require(rs).ServeHTTP(w, r)
+}
+
+//gossipSet lets members know a replicated set changed here
+func (ac *gitServer) gossipSet(rs *replicatedSet) error {
+	return ac.gossip.EmitSetUpdate(&SetUpdate{Set: rs.name, From: fmt.Sprintf("http://%s", net.JoinHostPort(ac.ip.String(), strconv.Itoa(ac.port)))})
+}
+
+//SyncSet merges a replicated set from the member that changed it
+func (ac *gitServer) SyncSet(u *SetUpdate) error {
+	rs, ok := ac.sets[u.Set]
+	if !ok {
+		return fmt.Errorf("Unknown replicated set '%s'", u.Set)
+	}
+
+	changed, err := rs.Fetch(fmt.Sprintf("%s/sets/%s", u.From, u.Set))
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		log.Printf("Merged replicated set '%s' from '%s'", u.Set, u.From)
+	}
+
+	return nil
+}
+
+//syncSets merges the replicated sets of all members, changes that
+//were gossiped while we were down are picked up this way
+func (ac *gitServer) syncSets() {
+	members, err := ac.gossip.Members()
+	if err != nil {
+		log.Printf("Failed to list members for syncing replicated sets: %s", err)
+		return
+	}
+
+	for _, m := range members {
+		if m.IP() == nil || m.IP().Equal(ac.ip) {
+			continue
+		}
+
+		for name := range ac.sets {
+			err := ac.SyncSet(&SetUpdate{Set: name, From: fmt.Sprintf("http://%s", net.JoinHostPort(m.IP().String(), strconv.Itoa(ac.port)))})
+			if err != nil {
+				log.Printf("Failed to sync replicated set '%s' from '%s': %s", name, m.Name, err)
+			}
 		}
 	}
 }
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//testExchange is an exchange that never transfers anything
+type testExchange struct {
+	*transferFeed
+}
+
+func (x *testExchange) Start() error                                 { return nil }
+func (x *testExchange) Stop() error                                  { return nil }
+func (x *testExchange) CreateLink(name, path string) (string, error) { return "test:" + name, nil }
+func (x *testExchange) SeedLink(link, dir string) error              { return nil }
+func (x *testExchange) Pull(link, dir string) error                  { return nil }
+func (x *testExchange) Drop(link string) error                       { return nil }
+func (x *testExchange) Transfers() []Transfer                        { return []Transfer{} }
+func (x *testExchange) OnComplete(fn CompleteFunc)                   {}
+
+//testServer returns a git server that isn't started, requests are
+//served by calling it directly
+func testServer(t *testing.T) *gitServer {
+	auth, err := NewClusterAuth("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := NewDataDir(testDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := StorageConf{Port: 3838, Data: data, FetchThreshold: 1024 * 1024, Auth: auth, AutoCreate: true, Node: "test"}
+	ac, err := NewGitServer(conf, &testExchange{transferFeed: newTransferFeed()}, &testGossip{}, net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ac
+}
+
+//testRequest serves a request with basic auth of user, when it isn't
+//empty, and returns the response
+func testRequest(ac *gitServer, r *http.Request, user string) *httptest.ResponseRecorder {
+	if user != "" {
+		r.SetBasicAuth(user, user+"-password")
+	}
+
+	w := httptest.NewRecorder()
+	ac.ServeHTTP(w, r)
+	return w
+}
+
+//testUser adds a user with a password derived from its name
+func testUser(t *testing.T, ac *gitServer, name string, admin bool) {
+	err := ac.access.AddUser(&UserRequest{Name: name, Password: name + "-password", Admin: admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeOutsideTransferWindow(t *testing.T) {
+	ac := testServer(t)
+	testUser(t, ac, "alice", false)
+
+	//a window that opened two hours ago and closed an hour ago
+	now := time.Now()
+	since := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+	from := (since + 22*time.Hour) % (24 * time.Hour)
+	ac.bandwidth = NewBandwidth(TransferLimits{Windows: []TransferWindow{{From: from, To: (from + time.Hour) % (24 * time.Hour)}}})
+
+	loc := "/test.git/info/refs?service=git-upload-pack"
+	r := httptest.NewRequest("GET", loc, nil)
+	r.SetBasicAuth(memberUser, ac.access.memberPassword())
+	w := testRequest(ac, r, "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected members to be refused outside of the window, got: %d", w.Code)
+	}
+
+	w = testRequest(ac, httptest.NewRequest("GET", "/chunks/"+chunkHash([]byte("chunk")), nil), "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected chunks to be refused outside of the window, got: %d", w.Code)
+	}
+
+	w = testRequest(ac, httptest.NewRequest("GET", loc, nil), "alice")
+	if w.Code == http.StatusServiceUnavailable {
+		t.Errorf("expected users to be served outside of the window")
+	}
+}
+
+func TestDenyGitClientsWithoutUsers(t *testing.T) {
+	ac := testServer(t)
+	w := testRequest(ac, httptest.NewRequest("GET", "/test.git/info/refs?service=git-receive-pack", nil), "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous pushes to be refused without users, got: %d", w.Code)
+	}
+
+	if !ac.access.Allowed(memberUser, "test", false) || ac.access.Allowed(memberUser, "test", true) {
+		t.Errorf("expected members to only fetch without users")
+	}
+
+	if ac.access.Allowed("", "test", false) {
+		t.Errorf("expected anonymous fetches to be refused without users")
+	}
+}
+
+func TestMemberEndpointsRequireClusterAuth(t *testing.T) {
+	ac := testServer(t)
+	for _, loc := range []string{
+		"/chunks/" + chunkHash([]byte("chunk")),
+		"/has?repo=test&snapshot=" + zeroID,
+		"/refs?repo=test&snapshot=" + zeroID,
+		"/lfs/objects/test/" + chunkHash([]byte("object")),
+	} {
+		w := testRequest(ac, httptest.NewRequest("GET", loc, nil), "")
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected '%s' without cluster auth to be unauthorized, got: %d", loc, w.Code)
+		}
+
+		r := httptest.NewRequest("GET", loc, nil)
+		err := ac.auth.Sign(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w = testRequest(ac, r, "")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected '%s' with cluster auth to be served, got: %d", loc, w.Code)
+		}
+	}
+}
+
+func TestDenyInvalidCredentials(t *testing.T) {
+	ac := testServer(t)
+	testUser(t, ac, "alice", false)
+	err := ac.access.Grant(&Grant{User: "*", Repo: "test", Access: AccessRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{memberUser, "alice", ""} {
+		r := httptest.NewRequest("GET", "/test.git/info/refs?service=git-upload-pack", nil)
+		r.SetBasicAuth(user, "wrong-password")
+		w := httptest.NewRecorder()
+		ac.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected a wrong password for '%s' to be unauthorized, got: %d", user, w.Code)
+		}
+	}
+
+	if ac.access.Allowed("", "test", false) || !ac.access.Allowed("alice", "test", false) {
+		t.Errorf("expected a grant to '*' to be for every user but not for anonymous clients")
+	}
+}
@@ -0,0 +1,458 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func NewObjectSwarm(gossip Gossip, ip net.IP, root string, port int, bw *Bandwidth, auth *ClusterAuth) (Exchange, error) {
+	return &objectSwarm{
+		root:      root,
+		port:      port,
+		gossip:    gossip,
+		ip:        ip,
+		auth:      auth,
+		bandwidth: bw,
+		stop:      make(chan struct{}),
+		transfers: map[string]*Transfer{},
+
+		transferFeed: newTransferFeed(),
+	}, nil
+}
+
+//object swarm transfers the git objects of a repository from several
+//members at once: the missing commits are split in disjoint ranges
+//and every member that has them is asked for a pack of one range.
+//Links address a commit of a repository, no metadata is created.
+//Packs hold every branch of a repository so only members get them
+type objectSwarm struct {
+	root      string
+	port      int
+	gossip    Gossip
+	ip        net.IP
+	auth      *ClusterAuth
+	listener  net.Listener
+	bandwidth *Bandwidth
+	stop      chan struct{}
+
+	mu        sync.Mutex
+	transfers map[string]*Transfer
+	complete  []CompleteFunc
+
+	*transferFeed
+}
+
+//a range of commits, packed by a single member
+type commitRange struct {
+	want string
+	have string
+}
+
+func swarmLink(repo, commit string) string {
+	return fmt.Sprintf("gitswarm:%s?repo=%s", commit, url.QueryEscape(repo))
+}
+
+func parseSwarmLink(link string) (repo string, commit string, err error) {
+	loc, err := url.Parse(link)
+	if err != nil {
+		return "", "", err
+	}
+
+	if loc.Scheme != "gitswarm" || loc.Opaque == "" || loc.Query().Get("repo") == "" {
+		return "", "", fmt.Errorf("Invalid object swarm link '%s'", link)
+	}
+
+	return loc.Query().Get("repo"), loc.Opaque, nil
+}
+
+func (sw *objectSwarm) Start() error {
+	var err error
+	bind := net.JoinHostPort(sw.ip.String(), strconv.Itoa(sw.port))
+	sw.listener, err = net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Printf("Object swarm listening on '%s'...", bind)
+		err := http.Serve(sw.listener, sw.auth.Require(sw))
+		if err != nil && !strings.Contains(err.Error(), "closed network connection") {
+			log.Printf("Object swarm failed: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func (sw *objectSwarm) Stop() error {
+	close(sw.stop)
+	return sw.listener.Close()
+}
+
+//repopath resolves a repository name without leaving the root
+func (sw *objectSwarm) repopath(repo string) (string, error) {
+	path := filepath.Join(sw.root, repo)
+	if !strings.HasPrefix(path, filepath.Clean(sw.root)+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid repository '%s'", repo)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+//knownHaves filters the haves to the commits that the repository has,
+//a peer may send commits that only exist on its side
+func knownHaves(repopath string, haves []string) []string {
+	known := []string{}
+	for _, h := range haves {
+		if hasCommit(repopath, h) {
+			known = append(known, h)
+		}
+	}
+
+	return known
+}
+
+func (sw *objectSwarm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	repopath, err := sw.repopath(q.Get("repo"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	want := q.Get("want")
+	if !hasCommit(repopath, want) {
+		http.NotFound(w, r)
+		return
+	}
+
+	revs := []string{want}
+	for _, h := range knownHaves(repopath, q["have"]) {
+		revs = append(revs, fmt.Sprintf("^%s", h))
+	}
+
+	switch r.URL.Path {
+	case "/revs":
+		//all commits we would send, oldest first
+		out, err := git(repopath, append([]string{"rev-list", "--reverse"}, revs...)...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, out)
+	case "/pack":
+		//outside of transfer windows peers try another member
+		if !sw.bandwidth.Open(time.Now()) {
+			http.Error(w, "Outside of transfer window", http.StatusServiceUnavailable)
+			return
+		}
+
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+		//self contained pack, ranges can be indexed in any order
+		cmd := exec.Command("git", "pack-objects", "--revs", "--stdout", "-q")
+		cmd.Dir = repopath
+		cmd.Stdin = strings.NewReader(strings.Join(revs, "\n") + "\n")
+		cmd.Stdout = &limitedWriter{w: w, limiters: sw.bandwidth.uploadTo(host)}
+		cmd.Stderr = os.Stderr
+		w.Header().Set("Content-Type", "application/x-git-packed-objects")
+		err := cmd.Run()
+		if err != nil {
+			log.Printf("Failed to pack objects of '%s' for '%s': %s", repopath, r.RemoteAddr, err)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (sw *objectSwarm) query(m *Member, path, repo string, cr commitRange, haves []string) (*http.Response, error) {
+	q := url.Values{"repo": {repo}, "want": {cr.want}, "have": haves}
+	if cr.have != "" {
+		q.Add("have", cr.have)
+	}
+
+	resp, err := sw.auth.Get(fmt.Sprintf("http://%s%s?%s", net.JoinHostPort(m.IP().String(), strconv.Itoa(sw.port)), path, q.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Member '%s' responded with: %s", m.Name, resp.Status)
+	}
+
+	return resp, nil
+}
+
+//CreateLink addresses the current head of the repository at path
+func (sw *objectSwarm) CreateLink(name, path string) (string, error) {
+	commit, err := headCommit(path)
+	if err != nil {
+		return "", err
+	}
+
+	return swarmLink(name, commit), nil
+}
+
+//SeedLink is a no-op, objects are packed straight from the repositories
+func (sw *objectSwarm) SeedLink(link, dir string) error {
+	_, _, err := parseSwarmLink(link)
+	return err
+}
+
+//Pull fetches all objects of the linked commit into the repository at
+//dir, refs are not touched: that is up to the storage on completion
+func (sw *objectSwarm) Pull(link, dir string) error {
+	repo, commit, err := parseSwarmLink(link)
+	if err != nil {
+		return err
+	}
+
+	//failed transfers are retried by pulling them again
+	sw.mu.Lock()
+	if existing, ok := sw.transfers[link]; ok && existing.Error == "" {
+		sw.mu.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	t := &Transfer{Link: link, Name: repo, Dir: dir, Started: now, Updated: now}
+	sw.transfers[link] = t
+	sw.mu.Unlock()
+
+	go func() {
+		done := make(chan struct{})
+		go sw.report(t, done)
+		err := sw.pull(t, repo, commit, dir)
+		close(done)
+		if err != nil {
+			log.Printf("Failed to pull '%s' at '%s' from the object swarm: %s", repo, commit, err)
+			sw.mu.Lock()
+			t.Error = err.Error()
+			res := *t
+			sw.mu.Unlock()
+
+			sw.publish(res)
+			return
+		}
+
+		sw.mu.Lock()
+		t.Done = true
+		t.Updated = time.Now()
+		res := *t
+		fns := append([]CompleteFunc{}, sw.complete...)
+		sw.mu.Unlock()
+
+		log.Printf("Transfer of '%s' completed (%d bytes) into '%s'", res.Name, res.Completed, res.Dir)
+		for _, fn := range fns {
+			fn(res)
+		}
+
+		sw.publish(res)
+	}()
+
+	return nil
+}
+
+//report publishes the progress of a transfer every second until done
+func (sw *objectSwarm) report(t *Transfer, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Second):
+		}
+
+		sw.mu.Lock()
+		res := *t
+		sw.mu.Unlock()
+		sw.publish(res)
+	}
+}
+
+func (sw *objectSwarm) pull(t *Transfer, repo, commit, dir string) error {
+	err := initRepo(dir)
+	if err != nil {
+		return err
+	}
+
+	out, err := git(dir, "for-each-ref", "--format=%(objectname)", "refs/heads", "refs/tags")
+	if err != nil {
+		return err
+	}
+
+	haves := strings.Fields(out)
+
+	//ask all members which commits they would send, the ones
+	//that answer have the commit and become providers
+	members, err := sw.gossip.Members()
+	if err != nil {
+		return err
+	}
+
+	var commits []string
+	providers := []*Member{}
+	for _, m := range members {
+		if m.IP() == nil || m.IP().Equal(sw.ip) {
+			continue
+		}
+
+		resp, err := sw.query(m, "/revs", repo, commitRange{want: commit}, haves)
+		if err != nil {
+			continue
+		}
+
+		if commits == nil {
+			commits = []string{}
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" {
+					commits = append(commits, line)
+				}
+			}
+		}
+
+		resp.Body.Close()
+		providers = append(providers, m)
+	}
+
+	if len(providers) == 0 {
+		return fmt.Errorf("No member has commit '%s' of '%s'", commit, repo)
+	}
+
+	sw.mu.Lock()
+	t.Peers = len(providers)
+	sw.mu.Unlock()
+
+	//split the commits in one contiguous range per provider, the
+	//last commit of the previous range is the boundary of the next
+	ranges := []commitRange{}
+	n := len(providers)
+	if n > len(commits) {
+		n = len(commits)
+	}
+
+	prev := ""
+	for i := 0; i < n; i++ {
+		last := commits[(i+1)*len(commits)/n-1]
+		ranges = append(ranges, commitRange{want: last, have: prev})
+		prev = last
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(ranges))
+	for i, cr := range ranges {
+		wg.Add(1)
+		go func(i int, cr commitRange) {
+			defer wg.Done()
+
+			//on failure the range is retried with the next provider
+			var err error
+			for j := 0; j < len(providers); j++ {
+				if !sw.bandwidth.waitOpen(sw.stop) {
+					errs <- fmt.Errorf("Exchange stopped")
+					return
+				}
+
+				m := providers[(i+j)%len(providers)]
+				err = sw.fetchRange(t, m, repo, cr, haves, dir)
+				if err == nil {
+					return
+				}
+
+				log.Printf("Failed to fetch range '%s..%s' from '%s': %s", cr.have, cr.want, m.Name, err)
+			}
+
+			errs <- err
+		}(i, cr)
+	}
+
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	//all objects of the commit must now be present
+	_, err = git(dir, "rev-list", "--objects", "--quiet", commit)
+	return err
+}
+
+//fetchRange streams a pack of the range into the repository, index-pack
+//hashes and checks every object so nothing is stored under a wrong id.
+//Ranges arrive in any order so a pack may refer to objects of a range
+//that isn't there yet, connectivity is only checked once all arrived
+func (sw *objectSwarm) fetchRange(t *Transfer, m *Member, repo string, cr commitRange, haves []string, dir string) error {
+	resp, err := sw.query(m, "/pack", repo, cr, haves)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	cmd := exec.Command("git", "index-pack", "--stdin", "--fsck-objects")
+	cmd.Dir = dir
+	cmd.Stdin = io.TeeReader(&limitedReader{r: resp.Body, limiters: sw.bandwidth.downloadFrom(m.IP().String())}, &progressWriter{sw: sw, t: t})
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+//counts received bytes as progress of a transfer
+type progressWriter struct {
+	sw *objectSwarm
+	t  *Transfer
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	pw.sw.mu.Lock()
+	defer pw.sw.mu.Unlock()
+	pw.t.Completed += int64(len(b))
+	pw.t.Updated = time.Now()
+	return len(b), nil
+}
+
+func (sw *objectSwarm) Transfers() []Transfer {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	ts := []Transfer{}
+	for _, t := range sw.transfers {
+		ts = append(ts, *t)
+	}
+
+	return ts
+}
+
+//Drop forgets a transfer that finished, running pulls can't be
+//interrupted and are kept
+func (sw *objectSwarm) Drop(link string) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if t, ok := sw.transfers[link]; ok && (t.Done || t.Error != "") {
+		delete(sw.transfers, link)
+	}
+
+	return nil
+}
+
+func (sw *objectSwarm) OnComplete(fn CompleteFunc) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.complete = append(sw.complete, fn)
+}
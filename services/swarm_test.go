@@ -0,0 +1,147 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+//testCommits creates a repository at dir with n commits on master
+//that each add a file, it returns the commits oldest first
+func testCommits(t *testing.T, dir string, n int) []string {
+	_, err := git(filepath.Dir(dir), "init", "-q", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commits := []string{}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(fmt.Sprintf("content %d\n", i)), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = git(dir, "add", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = git(dir, "-c", "user.name=test", "-c", "user.email=test@cellstate", "commit", "-q", "-m", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		commit, err := git(dir, "rev-parse", "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		commits = append(commits, commit)
+	}
+
+	return commits
+}
+
+func TestSwarmFetchRangesOutOfOrder(t *testing.T) {
+	auth, err := NewClusterAuth("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := testDir(t)
+	commits := testCommits(t, filepath.Join(root, "test.git"), 4)
+
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Can't listen on a second loopback address: %s", err)
+	}
+
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	member := &Member{Name: "provider", Addr: "127.0.0.2:7946"}
+	provider, err := NewObjectSwarm(&testGossip{}, member.IP(), root, port, NewBandwidth(TransferLimits{}), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = provider.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer provider.Stop()
+	x, err := NewObjectSwarm(&testGossip{members: []*Member{member}}, net.ParseIP("127.0.0.1"), testDir(t), port, NewBandwidth(TransferLimits{}), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sw := x.(*objectSwarm)
+	dir := filepath.Join(testDir(t), "test.git")
+	err = initRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the later range refers to trees and blobs of the earlier one
+	tr := &Transfer{}
+	for _, cr := range []commitRange{{want: commits[3], have: commits[1]}, {want: commits[1]}} {
+		err = sw.fetchRange(tr, member, "test.git", cr, nil, dir)
+		if err != nil {
+			t.Fatalf("failed to fetch range '%s..%s': %s", cr.have, cr.want, err)
+		}
+	}
+
+	_, err = git(dir, "rev-list", "--objects", "--quiet", commits[3])
+	if err != nil {
+		t.Errorf("expected all objects to be present: %s", err)
+	}
+}
+
+func TestSwarmRequiresClusterAuth(t *testing.T) {
+	auth, err := NewClusterAuth("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := testDir(t)
+	commits := testCommits(t, filepath.Join(root, "test.git"), 1)
+	x, err := NewObjectSwarm(&testGossip{}, net.ParseIP("127.0.0.1"), root, 0, NewBandwidth(TransferLimits{}), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sw := x.(*objectSwarm)
+	err = sw.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sw.Stop()
+	for _, path := range []string{"/revs", "/pack"} {
+		loc := fmt.Sprintf("http://%s%s?repo=test.git&want=%s", sw.listener.Addr(), path, commits[0])
+		resp, err := http.Get(loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected '%s' without cluster auth to be unauthorized, got: %s", path, resp.Status)
+		}
+
+		resp, err = auth.Get(loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected '%s' with cluster auth to succeed, got: %s", path, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+const (
+	//number of peers returned when the client doesn't specify numwant
+	DefaultNumWant = 50
+
+	//upper limit on the number of peers returned in a single announce
+	MaxNumWant = 200
+)
+
+func NewTracker(bind string, interval time.Duration, auth *ClusterAuth) (*tracker, error) {
+	return &tracker{
+		bind:        bind,
+		auth:        auth,
+		interval:    interval,
+		minInterval: interval / 2,
+		ttl:         interval*2 + interval/2,
+		swarms:      map[string]*swarm{},
+		stop:        make(chan struct{}),
+	}, nil
+}
+
+//a peer as known by the tracker, peers that stopped are
+//kept until they expire such that other trackers learn about it
+type trackedPeer struct {
+	ID      string
+	IP4     net.IP
+	IP6     net.IP
+	Port    int
+	Left    int64
+	Stopped bool
+	Seen    time.Time
+}
+
+//all peers of a single info hash
+type swarm struct {
+	peers      map[string]*trackedPeer
+	downloaded int
+}
+
+func (s *swarm) counts() (complete int, incomplete int) {
+	for _, p := range s.peers {
+		if p.Stopped {
+			continue
+		}
+
+		if p.Left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+
+	return complete, incomplete
+}
+
+//non-compact peer representation
+type peerDict struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+type announceResponse struct {
+	Interval    int64       `bencode:"interval"`
+	MinInterval int64       `bencode:"min interval"`
+	Complete    int         `bencode:"complete"`
+	Incomplete  int         `bencode:"incomplete"`
+	Peers       interface{} `bencode:"peers"`
+	Peers6      []byte      `bencode:"peers6,omitempty"`
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+type scrapeResponse struct {
+	Files map[string]scrapeFile `bencode:"files"`
+}
+
+//a peer as exchanged between trackers, binary ids are hex encoded
+//and the age is used instead of a timestamp such that clocks don't
+//need to agree
+type syncPeer struct {
+	InfoHash string `json:"info_hash"`
+	ID       string `json:"peer_id"`
+	IP4      net.IP `json:"ip4,omitempty"`
+	IP6      net.IP `json:"ip6,omitempty"`
+	Port     int    `json:"port"`
+	Left     int64  `json:"left"`
+	Stopped  bool   `json:"stopped,omitempty"`
+	Age      int64  `json:"age"`
+}
+
+type failureResponse struct {
+	Reason string `bencode:"failure reason"`
+}
+
+//tracker is a http bittorrent tracker that keeps its
+//swarms in memory, peers that stop announcing expire.
+//Only members may sync peers with it
+type tracker struct {
+	bind        string
+	auth        *ClusterAuth
+	interval    time.Duration
+	minInterval time.Duration
+	ttl         time.Duration
+	listener    net.Listener
+	stop        chan struct{}
+
+	mu     sync.RWMutex
+	swarms map[string]*swarm
+}
+
+func (t *tracker) Start() error {
+	var err error
+	t.listener, err = net.Listen("tcp", t.bind)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.Printf("Starting tracker on '%s'...", t.bind)
+		err := http.Serve(t.listener, t)
+		if err != nil && !strings.Contains(err.Error(), "closed network connection") {
+			log.Printf("Tracker failed: %s", err)
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-time.After(t.ttl / 2):
+				t.Expire(time.Now())
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *tracker) Stop() error {
+	close(t.stop)
+	return t.listener.Close()
+}
+
+func (t *tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/announce":
+		t.serveAnnounce(w, r)
+	case "/scrape":
+		t.serveScrape(w, r)
+	case "/sync":
+		t.auth.Require(http.HandlerFunc(t.serveSync)).ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//Expire removes all peers that haven't announced within the ttl
+func (t *tracker) Expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ih, s := range t.swarms {
+		for id, p := range s.peers {
+			if now.Sub(p.Seen) > t.ttl {
+				delete(s.peers, id)
+			}
+		}
+
+		//the download count of a swarm goes with its last peer
+		if len(s.peers) == 0 {
+			delete(t.swarms, ih)
+		}
+	}
+}
+
+func (t *tracker) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ih := q.Get("info_hash")
+	if len(ih) != 20 {
+		t.fail(w, "invalid info_hash")
+		return
+	}
+
+	id := q.Get("peer_id")
+	if len(id) != 20 {
+		t.fail(w, "invalid peer_id")
+		return
+	}
+
+	port, err := strconv.Atoi(q.Get("port"))
+	if err != nil || port < 1 || port > 65535 {
+		t.fail(w, "invalid port")
+		return
+	}
+
+	left, err := strconv.ParseInt(q.Get("left"), 10, 64)
+	if err != nil {
+		left = -1
+	}
+
+	numwant := DefaultNumWant
+	if q.Get("numwant") != "" {
+		numwant, err = strconv.Atoi(q.Get("numwant"))
+		if err != nil || numwant < 0 {
+			t.fail(w, "invalid numwant")
+			return
+		}
+	}
+
+	if numwant > MaxNumWant {
+		numwant = MaxNumWant
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		t.fail(w, "invalid remote address")
+		return
+	}
+
+	p := &trackedPeer{ID: id, Port: port, Left: left, Seen: time.Now()}
+	for _, addr := range []string{host, q.Get("ip"), q.Get("ipv4"), q.Get("ipv6")} {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+
+		if ip.To4() != nil && p.IP4 == nil {
+			p.IP4 = ip.To4()
+		} else if ip.To4() == nil && p.IP6 == nil {
+			p.IP6 = ip
+		}
+	}
+
+	resp := t.Announce(ih, p, q.Get("event"), numwant, q.Get("compact") == "1", q.Get("no_peer_id") == "1")
+	t.write(w, resp)
+}
+
+//Announce registers the peer for the info hash and returns the
+//response with at most numwant other peers in the swarm
+func (t *tracker) Announce(ih string, p *trackedPeer, event string, numwant int, compact bool, noPeerID bool) *announceResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.swarms[ih]
+	if !ok {
+		s = &swarm{peers: map[string]*trackedPeer{}}
+		t.swarms[ih] = s
+	}
+
+	switch event {
+	case "stopped":
+		p.Stopped = true
+		s.peers[p.ID] = p
+		numwant = 0
+	case "completed":
+		s.downloaded++
+		s.peers[p.ID] = p
+	default:
+		s.peers[p.ID] = p
+	}
+
+	resp := &announceResponse{
+		Interval:    int64(t.interval / time.Second),
+		MinInterval: int64(t.minInterval / time.Second),
+	}
+
+	resp.Complete, resp.Incomplete = s.counts()
+	peers4 := bytes.NewBuffer(nil)
+	peers6 := bytes.NewBuffer(nil)
+	dicts := []peerDict{}
+	n := 0
+	for _, other := range s.peers {
+		if n >= numwant {
+			break
+		}
+
+		//don't return the requester to itself and don't
+		//bother seeders with other seeders
+		if other.ID == p.ID || other.Stopped || (p.Left == 0 && other.Left == 0) {
+			continue
+		}
+
+		if time.Since(other.Seen) > t.ttl {
+			continue
+		}
+
+		n++
+		if compact {
+			writeCompactPeer(peers4, peers6, other)
+			continue
+		}
+
+		for _, ip := range []net.IP{other.IP4, other.IP6} {
+			if ip == nil {
+				continue
+			}
+
+			d := peerDict{IP: ip.String(), Port: other.Port}
+			if !noPeerID {
+				d.PeerID = other.ID
+			}
+
+			dicts = append(dicts, d)
+		}
+	}
+
+	if compact {
+		resp.Peers = peers4.Bytes()
+		resp.Peers6 = peers6.Bytes()
+	} else {
+		resp.Peers = dicts
+	}
+
+	return resp
+}
+
+//writes the peer in the compact format of BEP 23 and BEP 7
+func writeCompactPeer(b4, b6 *bytes.Buffer, p *trackedPeer) {
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(p.Port))
+	if p.IP4 != nil {
+		b4.Write(p.IP4.To4())
+		b4.Write(port)
+	}
+
+	if p.IP6 != nil {
+		b6.Write(p.IP6.To16())
+		b6.Write(port)
+	}
+}
+
+func (t *tracker) serveScrape(w http.ResponseWriter, r *http.Request) {
+	ihs := r.URL.Query()["info_hash"]
+	for _, ih := range ihs {
+		if len(ih) != 20 {
+			t.fail(w, "invalid info_hash")
+			return
+		}
+	}
+
+	t.write(w, t.Scrape(ihs))
+}
+
+//Scrape returns swarm statistics for the given info hashes
+//or for all known info hashes if none are given
+func (t *tracker) Scrape(ihs []string) *scrapeResponse {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(ihs) == 0 {
+		for ih := range t.swarms {
+			ihs = append(ihs, ih)
+		}
+	}
+
+	resp := &scrapeResponse{Files: map[string]scrapeFile{}}
+	for _, ih := range ihs {
+		s, ok := t.swarms[ih]
+		if !ok {
+			continue
+		}
+
+		f := scrapeFile{Downloaded: s.downloaded}
+		f.Complete, f.Incomplete = s.counts()
+		resp.Files[ih] = f
+	}
+
+	return resp
+}
+
+//failures are reported with a 200 status as clients
+//only look at the bencoded failure reason
+func (t *tracker) fail(w http.ResponseWriter, reason string) {
+	log.Printf("Tracker request failed: %s", reason)
+	t.write(w, &failureResponse{Reason: reason})
+}
+
+func (t *tracker) write(w http.ResponseWriter, v interface{}) {
+	data, err := bencode.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to bencode tracker response: %s", err)
+		http.Error(w, fmt.Sprintf("Failed to bencode: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
+
+//Peers returns all peers known to this tracker in the
+//format that is exchanged with other trackers
+func (t *tracker) Peers() []syncPeer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	now := time.Now()
+	peers := []syncPeer{}
+	for ih, s := range t.swarms {
+		for _, p := range s.peers {
+			peers = append(peers, syncPeer{
+				InfoHash: hex.EncodeToString([]byte(ih)),
+				ID:       hex.EncodeToString([]byte(p.ID)),
+				IP4:      p.IP4,
+				IP6:      p.IP6,
+				Port:     p.Port,
+				Left:     p.Left,
+				Stopped:  p.Stopped,
+				Age:      int64(now.Sub(p.Seen) / time.Second),
+			})
+		}
+	}
+
+	return peers
+}
+
+//Merge adds peers learned from another tracker, for peers that
+//are known already the most recently seen version wins
+func (t *tracker) Merge(peers []syncPeer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for _, sp := range peers {
+		ih, err := hex.DecodeString(sp.InfoHash)
+		if err != nil || len(ih) != 20 {
+			continue
+		}
+
+		id, err := hex.DecodeString(sp.ID)
+		if err != nil || len(id) != 20 {
+			continue
+		}
+
+		//a negative age would keep the peer around forever, huge ages
+		//are clamped before they can overflow the duration
+		if sp.Age < 0 || sp.Age > int64(t.ttl/time.Second) {
+			continue
+		}
+
+		seen := now.Add(-time.Duration(sp.Age) * time.Second)
+
+		s, ok := t.swarms[string(ih)]
+		if !ok {
+			s = &swarm{peers: map[string]*trackedPeer{}}
+			t.swarms[string(ih)] = s
+		}
+
+		if p, ok := s.peers[string(id)]; ok && !p.Seen.Before(seen) {
+			continue
+		}
+
+		s.peers[string(id)] = &trackedPeer{
+			ID:      string(id),
+			IP4:     sp.IP4,
+			IP6:     sp.IP6,
+			Port:    sp.Port,
+			Left:    sp.Left,
+			Stopped: sp.Stopped,
+			Seen:    seen,
+		}
+	}
+}
+
+//Sync does a push-pull exchange of all known peers with the
+//tracker at the given base url, when all trackers do this with
+//random members peer lists spread throughout the cluster
+func (t *tracker) Sync(base string) error {
+	data, err := json.Marshal(t.Peers())
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.auth.Post(fmt.Sprintf("%s/sync", base), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to sync with tracker '%s': %s", base, resp.Status)
+	}
+
+	peers := []syncPeer{}
+	dec := json.NewDecoder(resp.Body)
+	err = dec.Decode(&peers)
+	if err != nil {
+		return err
+	}
+
+	t.Merge(peers)
+	return nil
+}
+
+func (t *tracker) serveSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sync must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	//the body is only verified once it was read to the end
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read peers: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	peers := []syncPeer{}
+	err = json.Unmarshal(body, &peers)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to decode peers: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	//reply with our state before merging
+	data, err := json.Marshal(t.Peers())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t.Merge(peers)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
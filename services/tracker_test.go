@@ -0,0 +1,363 @@
+package services
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+func testTracker(t *testing.T) *tracker {
+	auth, err := NewClusterAuth("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := NewTracker("127.0.0.1:0", time.Minute, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tr
+}
+
+//testID returns a 20 byte id such as info hashes and peer ids
+func testID(c string) string {
+	return strings.Repeat(c, 20)
+}
+
+func testPeer(id string, left int64, ip string) *trackedPeer {
+	p := &trackedPeer{ID: testID(id), Port: 6881, Left: left, Seen: time.Now()}
+	if parsed := net.ParseIP(ip); parsed.To4() != nil {
+		p.IP4 = parsed.To4()
+	} else {
+		p.IP6 = parsed
+	}
+
+	return p
+}
+
+func TestTrackerAnnounce(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		peers   []*trackedPeer
+		peer    *trackedPeer
+		event   string
+		numwant int
+		compact bool
+
+		complete   int
+		incomplete int
+		peers4     int
+		peers6     int
+	}{
+		{
+			name:       "first peer gets no peers",
+			peer:       testPeer("a", 10, "10.0.0.1"),
+			numwant:    DefaultNumWant,
+			compact:    true,
+			incomplete: 1,
+		},
+		{
+			name:       "leecher gets seeders and leechers",
+			peers:      []*trackedPeer{testPeer("b", 0, "10.0.0.2"), testPeer("c", 5, "10.0.0.3")},
+			peer:       testPeer("a", 10, "10.0.0.1"),
+			numwant:    DefaultNumWant,
+			compact:    true,
+			complete:   1,
+			incomplete: 2,
+			peers4:     2,
+		},
+		{
+			name:       "seeder doesn't get other seeders",
+			peers:      []*trackedPeer{testPeer("b", 0, "10.0.0.2"), testPeer("c", 5, "10.0.0.3")},
+			peer:       testPeer("a", 0, "10.0.0.1"),
+			numwant:    DefaultNumWant,
+			compact:    true,
+			complete:   2,
+			incomplete: 1,
+			peers4:     1,
+		},
+		{
+			name:       "numwant limits peers",
+			peers:      []*trackedPeer{testPeer("b", 5, "10.0.0.2"), testPeer("c", 5, "10.0.0.3"), testPeer("d", 5, "10.0.0.4")},
+			peer:       testPeer("a", 10, "10.0.0.1"),
+			numwant:    2,
+			compact:    true,
+			incomplete: 4,
+			peers4:     2,
+		},
+		{
+			name:       "ipv6 peers are returned as peers6",
+			peers:      []*trackedPeer{testPeer("b", 5, "fd00::2"), testPeer("c", 5, "10.0.0.3")},
+			peer:       testPeer("a", 10, "10.0.0.1"),
+			numwant:    DefaultNumWant,
+			compact:    true,
+			incomplete: 3,
+			peers4:     1,
+			peers6:     1,
+		},
+		{
+			name:       "non-compact peers are dicts",
+			peers:      []*trackedPeer{testPeer("b", 5, "fd00::2"), testPeer("c", 5, "10.0.0.3")},
+			peer:       testPeer("a", 10, "10.0.0.1"),
+			numwant:    DefaultNumWant,
+			incomplete: 3,
+			peers4:     1,
+			peers6:     1,
+		},
+		{
+			name:       "stopped peer gets no peers and isn't counted",
+			peers:      []*trackedPeer{testPeer("b", 5, "10.0.0.2")},
+			peer:       testPeer("a", 10, "10.0.0.1"),
+			event:      "stopped",
+			numwant:    DefaultNumWant,
+			compact:    true,
+			incomplete: 1,
+		},
+		{
+			name:     "expired peers are not returned",
+			peers:    []*trackedPeer{{ID: testID("b"), IP4: net.IPv4(10, 0, 0, 2).To4(), Port: 1, Left: 5, Seen: time.Now().Add(-time.Hour)}},
+			peer:     testPeer("a", 0, "10.0.0.1"),
+			numwant:  DefaultNumWant,
+			compact:  true,
+			complete: 1,
+
+			//expired peers are still counted until they are removed
+			incomplete: 1,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tr := testTracker(t)
+			ih := testID("i")
+			for _, p := range c.peers {
+				tr.Announce(ih, p, "", 0, true, false)
+			}
+
+			resp := tr.Announce(ih, c.peer, c.event, c.numwant, c.compact, false)
+			if resp.Complete != c.complete || resp.Incomplete != c.incomplete {
+				t.Errorf("expected %d complete and %d incomplete, got %d and %d", c.complete, c.incomplete, resp.Complete, resp.Incomplete)
+			}
+
+			peers4, peers6 := 0, 0
+			if c.compact {
+				peers4 = len(resp.Peers.([]byte)) / 6
+				peers6 = len(resp.Peers6) / 18
+			} else {
+				for _, d := range resp.Peers.([]peerDict) {
+					if net.ParseIP(d.IP).To4() != nil {
+						peers4++
+					} else {
+						peers6++
+					}
+
+					if d.PeerID == c.peer.ID {
+						t.Errorf("peer was returned to itself")
+					}
+				}
+			}
+
+			if peers4 != c.peers4 || peers6 != c.peers6 {
+				t.Errorf("expected %d ipv4 and %d ipv6 peers, got %d and %d", c.peers4, c.peers6, peers4, peers6)
+			}
+		})
+	}
+}
+
+func TestTrackerFailureReasons(t *testing.T) {
+	valid := url.Values{"info_hash": {testID("i")}, "peer_id": {testID("p")}, "port": {"6881"}, "left": {"0"}}
+	for _, c := range []struct {
+		name   string
+		key    string
+		value  string
+		reason string
+	}{
+		{name: "valid", reason: ""},
+		{name: "short info hash", key: "info_hash", value: "abc", reason: "invalid info_hash"},
+		{name: "short peer id", key: "peer_id", value: "abc", reason: "invalid peer_id"},
+		{name: "missing port", key: "port", value: "", reason: "invalid port"},
+		{name: "port out of range", key: "port", value: "70000", reason: "invalid port"},
+		{name: "negative numwant", key: "numwant", value: "-1", reason: "invalid numwant"},
+		{name: "numwant not a number", key: "numwant", value: "many", reason: "invalid numwant"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			q := url.Values{}
+			for k, v := range valid {
+				q[k] = v
+			}
+
+			if c.key != "" {
+				q.Set(c.key, c.value)
+			}
+
+			w := httptest.NewRecorder()
+			testTracker(t).ServeHTTP(w, httptest.NewRequest("GET", "/announce?"+q.Encode(), nil))
+			resp := &failureResponse{}
+			err := bencode.Unmarshal(w.Body.Bytes(), resp)
+			if err != nil {
+				t.Fatalf("failed to decode response: %s", err)
+			}
+
+			if resp.Reason != c.reason {
+				t.Errorf("expected failure reason '%s', got '%s'", c.reason, resp.Reason)
+			}
+		})
+	}
+}
+
+func TestTrackerNumWantIsCapped(t *testing.T) {
+	tr := testTracker(t)
+	ih := testID("i")
+	for i := 0; i < MaxNumWant+10; i++ {
+		p := testPeer("x", 5, "10.0.0.1")
+		p.ID = strings.Repeat("x", 16) + string([]byte{byte(i >> 8), byte(i), 0, 0})
+		tr.Announce(ih, p, "", 0, true, false)
+	}
+
+	q := url.Values{"info_hash": {ih}, "peer_id": {testID("p")}, "port": {"6881"}, "left": {"1"}, "compact": {"1"}, "numwant": {"1000"}}
+	w := httptest.NewRecorder()
+	tr.ServeHTTP(w, httptest.NewRequest("GET", "/announce?"+q.Encode(), nil))
+	resp := &struct {
+		Peers []byte `bencode:"peers"`
+	}{}
+
+	err := bencode.Unmarshal(w.Body.Bytes(), resp)
+	if err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	if len(resp.Peers)/6 != MaxNumWant {
+		t.Errorf("expected %d peers, got %d", MaxNumWant, len(resp.Peers)/6)
+	}
+}
+
+func TestTrackerExpire(t *testing.T) {
+	tr := testTracker(t)
+	tr.Announce(testID("i"), testPeer("a", 0, "10.0.0.1"), "completed", 0, true, false)
+	tr.Announce(testID("j"), testPeer("a", 5, "10.0.0.1"), "", 0, true, false)
+
+	tr.Expire(time.Now())
+	if len(tr.Scrape(nil).Files) != 2 {
+		t.Fatalf("expected peers that announced recently to be kept")
+	}
+
+	tr.Expire(time.Now().Add(tr.ttl + time.Second))
+	if len(tr.swarms) != 0 {
+		t.Errorf("expected all swarms to expire, %d are left", len(tr.swarms))
+	}
+}
+
+func TestTrackerScrape(t *testing.T) {
+	tr := testTracker(t)
+	tr.Announce(testID("i"), testPeer("a", 0, "10.0.0.1"), "completed", 0, true, false)
+	tr.Announce(testID("i"), testPeer("b", 5, "10.0.0.2"), "", 0, true, false)
+	tr.Announce(testID("i"), testPeer("c", 5, "10.0.0.3"), "stopped", 0, true, false)
+	tr.Announce(testID("j"), testPeer("a", 5, "10.0.0.1"), "", 0, true, false)
+
+	for _, c := range []struct {
+		name  string
+		ihs   []string
+		files map[string]scrapeFile
+	}{
+		{
+			name: "all swarms",
+			files: map[string]scrapeFile{
+				testID("i"): {Complete: 1, Incomplete: 1, Downloaded: 1},
+				testID("j"): {Incomplete: 1},
+			},
+		},
+		{
+			name:  "single swarm",
+			ihs:   []string{testID("j")},
+			files: map[string]scrapeFile{testID("j"): {Incomplete: 1}},
+		},
+		{
+			name:  "unknown swarm",
+			ihs:   []string{testID("k")},
+			files: map[string]scrapeFile{},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			files := tr.Scrape(c.ihs).Files
+			if len(files) != len(c.files) {
+				t.Fatalf("expected %d files, got %d", len(c.files), len(files))
+			}
+
+			for ih, f := range c.files {
+				if files[ih] != f {
+					t.Errorf("expected %+v for '%x', got %+v", f, ih, files[ih])
+				}
+			}
+		})
+	}
+}
+
+func TestTrackerSync(t *testing.T) {
+	a, b := testTracker(t), testTracker(t)
+	a.Announce(testID("i"), testPeer("a", 0, "10.0.0.1"), "", 0, true, false)
+	b.Announce(testID("i"), testPeer("b", 5, "10.0.0.2"), "", 0, true, false)
+
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+	err := a.Sync(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tr := range map[string]*tracker{"a": a, "b": b} {
+		f := tr.Scrape(nil).Files[testID("i")]
+		if f.Complete != 1 || f.Incomplete != 1 {
+			t.Errorf("expected tracker %s to know both peers, got %+v", name, f)
+		}
+	}
+}
+
+func TestTrackerSyncRequiresClusterAuth(t *testing.T) {
+	tr := testTracker(t)
+	srv := httptest.NewServer(tr)
+	defer srv.Close()
+
+	body := `[{"info_hash":"` + strings.Repeat("ab", 20) + `","peer_id":"` + strings.Repeat("cd", 20) + `","ip4":"10.0.0.9","port":1,"left":5,"age":0}]`
+	resp, err := http.Post(srv.URL+"/sync", "application/json", bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unsigned sync to be rejected, got %s", resp.Status)
+	}
+
+	if len(tr.swarms) != 0 {
+		t.Errorf("expected unsigned sync not to add peers")
+	}
+}
+
+func TestTrackerMergeAges(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		age  int64
+		kept bool
+	}{
+		{name: "recent", age: 10, kept: true},
+		{name: "expired", age: 3600},
+		{name: "in the future", age: -3600},
+		{name: "overflowing", age: math.MaxInt64},
+		{name: "overflowing into the future", age: math.MaxInt64/int64(time.Second) + 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tr := testTracker(t)
+			tr.Merge([]syncPeer{{InfoHash: strings.Repeat("ab", 20), ID: strings.Repeat("cd", 20), Port: 1, Left: 5, Age: c.age}})
+			if kept := len(tr.swarms) == 1; kept != c.kept {
+				t.Errorf("expected peer to be kept: %t, got %t", c.kept, kept)
+			}
+		})
+	}
+}
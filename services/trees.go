@@ -0,0 +1,187 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//number of checkouts kept per repository, the previous one is kept
+//such that readers that still have it open aren't cut off
+const keepCheckouts = 2
+
+func NewTreeStore(root string) (*treeStore, error) {
+	return &treeStore{
+		root:  root,
+		locks: map[string]*sync.Mutex{},
+	}, nil
+}
+
+//tree store keeps a checked out working tree of every repository
+//at '<root>/<repo>'. That path is a symlink to a checkout of a
+//single commit which is never modified, a new commit is checked
+//out next to it and the symlink is swapped once it is complete
+type treeStore struct {
+	root string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+//lock serializes updates of the tree of a single repository
+func (ts *treeStore) lock(repo string) *sync.Mutex {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	l, ok := ts.locks[repo]
+	if !ok {
+		l = &sync.Mutex{}
+		ts.locks[repo] = l
+	}
+
+	return l
+}
+
+//Path returns where the working tree of a repository can be read
+func (ts *treeStore) Path(repo string) string {
+	return filepath.Join(ts.root, repo)
+}
+
+//checkouts returns the directory with the checkouts of a repository,
+//names can't start with a dot so it never collides with a tree
+func (ts *treeStore) checkouts(repo string) string {
+	return filepath.Join(ts.root, ".checkouts", repo)
+}
+
+//Update points the working tree of a repository to a commit, it
+//returns once readers of the tree see the commit
+func (ts *treeStore) Update(repo, repopath, commit string) error {
+	l := ts.lock(repo)
+	l.Lock()
+	defer l.Unlock()
+
+	dir := filepath.Join(ts.checkouts(repo), commit)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err := ts.checkout(repopath, commit, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	//the modification time tells prune which checkouts were used last
+	now := time.Now()
+	err := os.Chtimes(dir, now, now)
+	if err != nil {
+		return err
+	}
+
+	err = ts.swap(ts.Path(repo), dir)
+	if err != nil {
+		return err
+	}
+
+	return ts.prune(repo, commit)
+}
+
+//checkout writes the files of a commit to dir, using an index of
+//its own such that the bare repository is left as it is
+func (ts *treeStore) checkout(repopath, commit, dir string) error {
+	tmp := fmt.Sprintf("%s.tmp", dir)
+	index := fmt.Sprintf("%s.index", dir)
+	defer os.Remove(index)
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(tmp, 0777)
+	if err != nil {
+		return err
+	}
+
+	env := []string{fmt.Sprintf("GIT_INDEX_FILE=%s", index)}
+	_, err = gitEnv(repopath, env, "--work-tree", tmp, "read-tree", commit)
+	if err != nil {
+		return err
+	}
+
+	_, err = gitEnv(repopath, env, "--work-tree", tmp, "checkout-index", "--all", "--force")
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dir)
+}
+
+//swap atomically replaces the symlink at link such that it points
+//to dir, the rename either happens completely or not at all
+func (ts *treeStore) swap(link, dir string) error {
+	err := os.MkdirAll(filepath.Dir(link), 0777)
+	if err != nil {
+		return err
+	}
+
+	target, err := filepath.Rel(filepath.Dir(link), dir)
+	if err != nil {
+		return err
+	}
+
+	tmp := fmt.Sprintf("%s.new", link)
+	os.Remove(tmp)
+	err = os.Symlink(target, tmp)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, link)
+}
+
+//prune removes all but the most recently used checkouts of a
+//repository and what an interrupted checkout left behind
+func (ts *treeStore) prune(repo, current string) error {
+	fis, err := ioutil.ReadDir(ts.checkouts(repo))
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(fis, func(i, j int) bool { return fis[i].ModTime().After(fis[j].ModTime()) })
+	kept := 1
+	for _, fi := range fis {
+		if fi.Name() == current {
+			continue
+		}
+
+		if filepath.Ext(fi.Name()) == "" && kept < keepCheckouts {
+			kept++
+			continue
+		}
+
+		err := os.RemoveAll(filepath.Join(ts.checkouts(repo), fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//updateTree checks out the head of a repository in its working tree
+func (ac *gitServer) updateTree(name string) {
+	repopath := filepath.Join(ac.root, name)
+	commit, err := headCommit(repopath)
+	if err != nil {
+		return
+	}
+
+	err = ac.trees.Update(name, repopath, commit)
+	if err != nil {
+		log.Printf("Failed to update working tree of '%s' to '%s': %s", name, commit, err)
+		return
+	}
+
+	log.Printf("Working tree '%s' is at '%s'", ac.trees.Path(name), commit)
+}
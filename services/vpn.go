@@ -102,8 +102,6 @@ func (z *zeroProcess) Join(network, iface string, cancel chan os.Signal) (net.IP
 		}
 
 	}
-
-	return nil, nil, nil
 }
 
 func (z *zeroProcess) Stop() error {